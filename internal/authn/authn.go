@@ -0,0 +1,110 @@
+// Package authn authenticates the bearer tokens clients present to the
+// server. GitHub is the default provider, a static token file, an OIDC
+// provider or GitLab can be used instead, so teams are not tied to personal
+// GitHub accounts.
+package authn
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Providers selectable in Config.
+const (
+	ProviderGitHub = "github"
+	ProviderStatic = "static"
+	ProviderOIDC   = "oidc"
+	ProviderGitLab = "gitlab"
+)
+
+// ErrInvalidToken is returned for tokens the provider rejected, as opposed
+// to failures reaching it.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrForbidden is returned for valid tokens of users that are not allowed
+// to use the server.
+var ErrForbidden = errors.New("access denied")
+
+// Identity is the user a token belongs to. Its login names the subdomains
+// the user may open tunnels on and is always a ValidLogin.
+type Identity struct {
+	Login    string
+	Provider string
+}
+
+// Authenticator resolves the identity behind a bearer token.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (Identity, error)
+}
+
+type Config struct {
+	// Provider is one of ProviderGitHub, ProviderStatic, ProviderOIDC or
+	// ProviderGitLab. When empty GitHub is used.
+	Provider string
+	// TokenFile lists the tokens of the static provider, see NewStatic.
+	TokenFile string
+	// GitHub restricts the github provider to members of organizations or
+	// teams.
+	GitHub GitHubAccess
+	// OIDC configures the oidc provider.
+	OIDC OIDCConfig
+	// GitLabURL is the GitLab instance tokens are checked against. When
+	// empty https://gitlab.com is used.
+	GitLabURL string
+	// CacheTTL is how long the identities looked up with GitHub or GitLab
+	// are cached and NegativeCacheTTL how long the tokens they rejected or
+	// denied access are. When zero DefaultCacheTTL and DefaultNegativeCacheTTL are used.
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+}
+
+// New returns the authenticator of the provider selected in cfg. github
+// looks up the users of the GitHub provider.
+func New(ctx context.Context, cfg Config, github auth.GithubUserProvider) (Authenticator, error) {
+	ttl := cmp.Or(cfg.CacheTTL, DefaultCacheTTL)
+	negativeTTL := cmp.Or(cfg.NegativeCacheTTL, DefaultNegativeCacheTTL)
+	switch cfg.Provider {
+	case "", ProviderGitHub:
+		a, err := GitHub(github, cfg.GitHub)
+		if err != nil {
+			return nil, err
+		}
+		return Cached(a, ttl, negativeTTL), nil
+	case ProviderStatic:
+		return NewStatic(cfg.TokenFile)
+	case ProviderOIDC:
+		return NewOIDC(ctx, cfg.OIDC)
+	case ProviderGitLab:
+		return Cached(NewGitLab(cfg.GitLabURL), ttl, negativeTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q", cfg.Provider)
+	}
+}
+
+// loginPattern is the charset of GitHub logins. Logins of every provider
+// are held to it: they never contain "--", which separates the name of a
+// tunnel from the login owning it, so no login can claim the named tunnels
+// of another.
+var loginPattern = regexp.MustCompile(`^[a-z0-9](-?[a-z0-9])*$`)
+
+// ValidLogin reports whether login can name subdomains.
+func ValidLogin(login string) bool {
+	return len(login) <= 39 && loginPattern.MatchString(login)
+}
+
+// checkLogin lowercases the user name reported by a provider and denies
+// access unless it is a valid login. Email addresses and the like are
+// rejected rather than cut down, so distinct users never share a login.
+func checkLogin(name string) (string, error) {
+	login := strings.ToLower(name)
+	if !ValidLogin(login) {
+		return "", fmt.Errorf("%w: %q is not a valid login, logins consist of letters, digits and single hyphens", ErrForbidden, name)
+	}
+	return login, nil
+}
@@ -0,0 +1,550 @@
+package authn
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	content := "# login token\nalice secret-a\n\nbob   secret-b\nalice secret-a2\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(context.Background(), Config{Provider: ProviderStatic, TokenFile: path}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for token, want := range map[string]string{"secret-a": "alice", "secret-a2": "alice", "secret-b": "bob"} {
+		id, err := a.Authenticate(context.Background(), token)
+		if err != nil || id.Login != want || id.Provider != ProviderStatic {
+			t.Errorf("Authenticate(%q) got = %+v, %v, want %s", token, id, err, want)
+		}
+	}
+	if _, err := a.Authenticate(context.Background(), "secret-c"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of unknown token error = %v, want ErrInvalidToken", err)
+	}
+
+	for _, content := range []string{"alice\n", "api--bob secret\n", "bob@corp.com secret\n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewStatic(path); err == nil {
+			t.Errorf("NewStatic() of %q succeeded", content)
+		}
+	}
+}
+
+func TestGitLab(t *testing.T) {
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/user" || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer glpat-ok") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer glpat-ok":
+			json.NewEncoder(w).Encode(map[string]any{"id": 1, "username": "Alice"})
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"id": 2, "username": "api--bob"})
+		}
+	}))
+	defer gitlab.Close()
+
+	a, err := New(context.Background(), Config{Provider: ProviderGitLab, GitLabURL: gitlab.URL + "/"}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	id, err := a.Authenticate(context.Background(), "glpat-ok")
+	if err != nil || id.Login != "alice" {
+		t.Errorf("Authenticate() got = %+v, %v, want alice", id, err)
+	}
+	if _, err := a.Authenticate(context.Background(), "glpat-bad"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of bad token error = %v, want ErrInvalidToken", err)
+	}
+	if _, err := a.Authenticate(context.Background(), "glpat-ok-namespaced"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Authenticate() of user named api--bob error = %v, want ErrForbidden", err)
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jose.JSONWebKey{Key: key.Public(), KeyID: "key1", Algorithm: string(jose.RS256), Use: "sig"}
+
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 issuer,
+			"jwks_uri":               issuer + "/keys",
+			"introspection_endpoint": issuer + "/introspect",
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/introspect", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "reqbouncer" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("token") != "opaque-ok" {
+			json.NewEncoder(w).Encode(map[string]any{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"active": true, "preferred_username": "bob"})
+	})
+	provider := httptest.NewServer(mux)
+	defer provider.Close()
+	issuer = provider.URL
+
+	sign := func(claims map[string]any) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "key1"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwt.Signed(signer).Claims(claims).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(aud string) map[string]any {
+		return map[string]any{
+			"iss":                issuer,
+			"aud":                aud,
+			"sub":                "1234",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"email":              "Alice@example.com",
+			"preferred_username": "alice",
+		}
+	}
+
+	t.Run("jwks", func(t *testing.T) {
+		a, err := New(context.Background(), Config{Provider: ProviderOIDC, OIDC: OIDCConfig{
+			Issuer:   issuer,
+			ClientID: "reqbouncer",
+		}}, nil)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		id, err := a.Authenticate(context.Background(), sign(claims("reqbouncer")))
+		if err != nil || id.Login != "alice" || id.Provider != ProviderOIDC {
+			t.Errorf("Authenticate() got = %+v, %v, want alice", id, err)
+		}
+		namespaced := claims("reqbouncer")
+		namespaced["preferred_username"] = "api--bob"
+		if _, err := a.Authenticate(context.Background(), sign(namespaced)); !errors.Is(err, ErrForbidden) {
+			t.Errorf("Authenticate() of user named api--bob error = %v, want ErrForbidden", err)
+		}
+		if _, err := a.Authenticate(context.Background(), sign(claims("other"))); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authenticate() of token for another audience error = %v, want ErrInvalidToken", err)
+		}
+		// Without a client ID tokens of every application of the provider
+		// would be accepted.
+		if _, err := New(context.Background(), Config{Provider: ProviderOIDC, OIDC: OIDCConfig{Issuer: issuer}}, nil); err == nil {
+			t.Errorf("New() without client id succeeded")
+		}
+		if _, err := a.Authenticate(context.Background(), "not-a-jwt"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authenticate() of malformed token error = %v, want ErrInvalidToken", err)
+		}
+
+		// Email addresses are not cut down to their local part, which would
+		// merge the users of different domains.
+		byEmail, err := New(context.Background(), Config{Provider: ProviderOIDC, OIDC: OIDCConfig{
+			Issuer:     issuer,
+			ClientID:   "reqbouncer",
+			LoginClaim: "email",
+		}}, nil)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if _, err := byEmail.Authenticate(context.Background(), sign(claims("reqbouncer"))); !errors.Is(err, ErrForbidden) {
+			t.Errorf("Authenticate() with an email login error = %v, want ErrForbidden", err)
+		}
+	})
+
+	t.Run("introspection", func(t *testing.T) {
+		a, err := New(context.Background(), Config{Provider: ProviderOIDC, OIDC: OIDCConfig{
+			Issuer:       issuer,
+			ClientID:     "reqbouncer",
+			ClientSecret: "s3cret",
+		}}, nil)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		id, err := a.Authenticate(context.Background(), "opaque-ok")
+		if err != nil || id.Login != "bob" {
+			t.Errorf("Authenticate() got = %+v, %v, want bob", id, err)
+		}
+		if _, err := a.Authenticate(context.Background(), "opaque-revoked"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Authenticate() of inactive token error = %v, want ErrInvalidToken", err)
+		}
+	})
+}
+
+func TestNew_UnknownProvider(t *testing.T) {
+	if _, err := New(context.Background(), Config{Provider: "ldap"}, nil); err == nil {
+		t.Errorf("New() of unknown provider succeeded")
+	}
+}
+
+// countingAuthenticator accepts the token "good", fails on "down" and
+// counts its lookups.
+type countingAuthenticator struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (a *countingAuthenticator) Authenticate(_ context.Context, token string) (Identity, error) {
+	a.calls.Add(1)
+	if a.release != nil {
+		<-a.release
+	}
+	switch token {
+	case "good":
+		return Identity{Login: "alice"}, nil
+	case "down":
+		return Identity{}, errors.New("provider unreachable")
+	default:
+		return Identity{}, ErrInvalidToken
+	}
+}
+
+func TestCached(t *testing.T) {
+	next := &countingAuthenticator{}
+	a := Cached(next, time.Hour, 50*time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if id, err := a.Authenticate(ctx, "good"); err != nil || id.Login != "alice" {
+			t.Fatalf("Authenticate() got = %+v, %v", id, err)
+		}
+	}
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("good token looked up %d times, want 1", got)
+	}
+
+	next.calls.Store(0)
+	for i := 0; i < 3; i++ {
+		if _, err := a.Authenticate(ctx, "bad"); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Authenticate() error = %v, want ErrInvalidToken", err)
+		}
+	}
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("bad token looked up %d times, want 1", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	a.Authenticate(ctx, "bad")
+	if got := next.calls.Load(); got != 2 {
+		t.Errorf("bad token looked up %d times after its negative TTL, want 2", got)
+	}
+
+	next.calls.Store(0)
+	a.Authenticate(ctx, "down")
+	a.Authenticate(ctx, "down")
+	if got := next.calls.Load(); got != 2 {
+		t.Errorf("failed lookups were cached, %d calls, want 2", got)
+	}
+}
+
+func TestCached_Bounded(t *testing.T) {
+	next := &countingAuthenticator{}
+	a := Cached(next, time.Hour, time.Hour).(*cache)
+	ctx := context.Background()
+
+	if _, err := a.Authenticate(ctx, "good"); err != nil {
+		t.Fatal(err)
+	}
+	// Guessed tokens only take the room of rejected ones.
+	for i := 0; i < 2*negativeCacheSize; i++ {
+		if _, err := a.Authenticate(ctx, fmt.Sprintf("guess-%d", i)); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Authenticate() of guessed token error = %v, want ErrInvalidToken", err)
+		}
+	}
+	if got := a.rejected.Len(); got != negativeCacheSize {
+		t.Errorf("cache holds %d rejected tokens, want %d", got, negativeCacheSize)
+	}
+
+	next.calls.Store(0)
+	if _, err := a.Authenticate(ctx, "good"); err != nil || next.calls.Load() != 0 {
+		t.Errorf("Authenticate() of good token after guesses got = %v with %d lookups, want it cached", err, next.calls.Load())
+	}
+	// The least recently used rejected tokens made room.
+	if _, err := a.Authenticate(ctx, "guess-0"); !errors.Is(err, ErrInvalidToken) || next.calls.Load() != 1 {
+		t.Errorf("Authenticate() of evicted token got = %v with %d lookups, want it looked up again", err, next.calls.Load())
+	}
+}
+
+func TestCached_Singleflight(t *testing.T) {
+	next := &countingAuthenticator{release: make(chan struct{})}
+	a := Cached(next, time.Hour, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if id, err := a.Authenticate(context.Background(), "good"); err != nil || id.Login != "alice" {
+				t.Errorf("Authenticate() got = %+v, %v", id, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(next.release)
+	wg.Wait()
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("concurrent lookups hit the provider %d times, want 1", got)
+	}
+}
+
+func TestGitHubAccess(t *testing.T) {
+	// The token of each user is its login.
+	users := func(token string) (auth.GitHubUser, error) {
+		return auth.GitHubUser{Login: token}, nil
+	}
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		state := ""
+		switch {
+		case token == "noscope":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case r.URL.Path == "/user/memberships/orgs/acme" && token == "alice":
+			state = "active"
+		case r.URL.Path == "/user/memberships/orgs/acme" && token == "dave":
+			state = "pending"
+		case r.URL.Path == "/orgs/acme/teams/platform/memberships/"+token && token == "carol":
+			state = "active"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"state": state})
+	}))
+	defer github.Close()
+
+	a, err := GitHub(users, GitHubAccess{APIURL: github.URL, Orgs: []string{"acme"}, Teams: []string{"acme/platform"}})
+	if err != nil {
+		t.Fatalf("GitHub() error = %v", err)
+	}
+	for _, login := range []string{"alice", "carol"} {
+		if id, err := a.Authenticate(context.Background(), login); err != nil || id.Login != login {
+			t.Errorf("Authenticate() of %s got = %+v, %v", login, id, err)
+		}
+	}
+	for _, login := range []string{"bob", "dave"} {
+		_, err := a.Authenticate(context.Background(), login)
+		if !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), login+" is not a member of the GitHub organization acme or team acme/platform") {
+			t.Errorf("Authenticate() of %s error = %v, want ErrForbidden", login, err)
+		}
+	}
+	if _, err := a.Authenticate(context.Background(), "noscope"); !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), "login again") {
+		t.Errorf("Authenticate() without read:org error = %v, want a hint to log in again", err)
+	}
+
+	if _, err := GitHub(users, GitHubAccess{Teams: []string{"platform"}}); err == nil {
+		t.Errorf("GitHub() with a team without org succeeded")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	if _, err := NewSessions(SessionConfig{Secret: "too-short"}); err == nil {
+		t.Errorf("NewSessions() with a short secret succeeded")
+	}
+	s, err := NewSessions(SessionConfig{Secret: strings.Repeat("k", 32), TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewSessions() error = %v", err)
+	}
+	a := s.Authenticator(&countingAuthenticator{}, ProviderGitHub)
+	ctx := context.Background()
+
+	session, err := s.Issue(Identity{Login: "alice", Provider: ProviderGitHub}, "good")
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if id, err := a.Authenticate(ctx, session.Token); err != nil || id.Login != "alice" || id.Provider != ProviderSession {
+		t.Errorf("Authenticate() of session got = %+v, %v, want alice", id, err)
+	}
+	if id, err := a.Authenticate(ctx, "good"); err != nil || id.Login != "alice" {
+		t.Errorf("Authenticate() of provider token got = %+v, %v, want alice", id, err)
+	}
+
+	// A static user named like a GitHub user is another user.
+	static, _ := s.Issue(Identity{Login: "alice", Provider: ProviderStatic}, "good")
+	if _, err := a.Authenticate(ctx, static.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of session of another provider error = %v, want ErrInvalidToken", err)
+	}
+
+	other, _ := NewSessions(SessionConfig{Secret: strings.Repeat("o", 32), TTL: time.Hour})
+	forged, _ := other.Issue(Identity{Login: "alice"}, "good")
+	if _, err := a.Authenticate(ctx, forged.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of session signed with another key error = %v, want ErrInvalidToken", err)
+	}
+
+	expiring, _ := NewSessions(SessionConfig{Secret: strings.Repeat("k", 32), TTL: time.Nanosecond})
+	expired, _ := expiring.Issue(Identity{Login: "alice"}, "good")
+	time.Sleep(time.Second)
+	if _, err := a.Authenticate(ctx, expired.Token); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Authenticate() of expired session error = %v, want ErrSessionExpired", err)
+	}
+
+	if err := s.Revoke(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(ctx, session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of revoked session error = %v, want ErrInvalidToken", err)
+	}
+
+	bob, _ := s.Issue(Identity{Login: "bob"}, "")
+	if err := s.RevokeLogin("bob", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(ctx, bob.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of session started before RevokeLogin error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestSessions_Recheck(t *testing.T) {
+	// Sessions tell when they started in seconds.
+	cfg := SessionConfig{Secret: strings.Repeat("k", 32), Recheck: 2 * time.Second, Credentials: newMemoryCredentials()}
+	s, err := NewSessions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingAuthenticator{}
+	a := s.Authenticator(next, "")
+	ctx := context.Background()
+
+	session, err := s.Issue(Identity{Login: "alice"}, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The provider token stays on the server.
+	parsed, err := jwt.ParseSigned(session.Token, []jose.SignatureAlgorithm{jose.HS256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := claims["cred"]; ok || strings.Contains(session.Token, "good") {
+		t.Errorf("Issue() got claims %v, want no provider token", claims)
+	}
+	revoked, _ := s.Issue(Identity{Login: "alice"}, "revoked")
+	ended, _ := s.Issue(Identity{Login: "alice"}, "good")
+	if err := s.Revoke(ended.ID); err != nil {
+		t.Fatal(err)
+	}
+	if credential, _ := cfg.Credentials.Credential(ended.ID); credential != "" {
+		t.Errorf("Revoke() kept the credential of the session")
+	}
+	// Instances sharing the store recheck sessions issued by the others.
+	shared, _ := NewSessions(cfg)
+	isolated, _ := NewSessions(SessionConfig{Secret: cfg.Secret, Recheck: cfg.Recheck})
+	unchecked, _ := NewSessions(SessionConfig{Secret: strings.Repeat("k", 32)})
+	old, _ := unchecked.Issue(Identity{Login: "alice"}, "good")
+	if _, err := a.Authenticate(ctx, session.Token); err != nil || next.calls.Load() != 0 {
+		t.Errorf("Authenticate() of new session got = %v with %d lookups, want no lookup", err, next.calls.Load())
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := a.Authenticate(ctx, session.Token); err != nil {
+			t.Errorf("Authenticate() of rechecked session error = %v", err)
+		}
+	}
+	if got := next.calls.Load(); got != 1 {
+		t.Errorf("rechecking hit the provider %d times, want 1", got)
+	}
+	if _, err := shared.Authenticator(next, "").Authenticate(ctx, session.Token); err != nil {
+		t.Errorf("Authenticate() of session on instance sharing the store error = %v", err)
+	}
+	if _, err := isolated.Authenticator(next, "").Authenticate(ctx, session.Token); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Authenticate() of session on instance without its credential error = %v, want ErrSessionExpired", err)
+	}
+
+	// Users losing access lose their sessions with it.
+	if _, err := a.Authenticate(ctx, revoked.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() of session of a rejected token error = %v, want ErrInvalidToken", err)
+	}
+
+	// Sessions started before rechecking was enabled cannot be rechecked.
+	if _, err := a.Authenticate(ctx, old.Token); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Authenticate() of session without provider token error = %v, want ErrSessionExpired", err)
+	}
+}
+
+// memoryRevocations is a RevocationStore shared by the Sessions of a test.
+type memoryRevocations struct {
+	sessions, logins map[string]time.Time
+}
+
+func (m *memoryRevocations) RevokeSession(id string, expires time.Time) error {
+	m.sessions[id] = expires
+	return nil
+}
+
+func (m *memoryRevocations) RevokeLogin(login string, before, _ time.Time) error {
+	m.logins[login] = before
+	return nil
+}
+
+func (m *memoryRevocations) Revocations() (sessions, logins map[string]time.Time, err error) {
+	return maps.Clone(m.sessions), maps.Clone(m.logins), nil
+}
+
+func TestSessions_Revocations(t *testing.T) {
+	store := &memoryRevocations{sessions: make(map[string]time.Time), logins: make(map[string]time.Time)}
+	cfg := SessionConfig{Secret: strings.Repeat("k", 32), Revocations: store}
+	s, err := NewSessions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := s.Issue(Identity{Login: "alice"}, "")
+	bob, _ := s.Issue(Identity{Login: "bob"}, "")
+	carol, _ := s.Issue(Identity{Login: "carol"}, "")
+	if err := s.Revoke(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeLogin("bob", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instances starting later know the revocations.
+	restarted, err := NewSessions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range []Session{alice, bob} {
+		if _, _, err := restarted.Verify(session.Token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify() of revoked session of %s after restart error = %v, want ErrInvalidToken", session.Login, err)
+		}
+	}
+	if _, _, err := restarted.Verify(carol.Token); err != nil {
+		t.Errorf("Verify() of session of carol after restart error = %v", err)
+	}
+}
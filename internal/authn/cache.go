@@ -0,0 +1,152 @@
+package authn
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+// Defaults of the cache TTLs in Config.
+const (
+	DefaultCacheTTL         = 5 * time.Minute
+	DefaultNegativeCacheTTL = time.Minute
+)
+
+// Sizes of the cache. Rejected tokens get less room of their own, so
+// callers guessing tokens cannot push out the identities of real users.
+const (
+	cacheSize         = 10000
+	negativeCacheSize = 1000
+)
+
+type cacheEntry struct {
+	identity Identity
+	err      error
+	expires  time.Time
+}
+
+// cache remembers the identities a provider resolved, so reconnecting
+// clients do not hit its API on every handshake. Rejected tokens and denied
+// users are remembered for a shorter while, failures to reach the provider
+// are not. Tokens are keyed by their hash, so the cache holds no
+// credentials.
+type cache struct {
+	next        Authenticator
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	entries  *lru
+	rejected *lru
+	mux      sync.Mutex
+	lookups  singleflight.Group
+}
+
+// Cached caches the identities resolved by next for ttl and the tokens it
+// rejected or denied access for negativeTTL. Concurrent lookups of the same
+// token share a single request to the provider.
+func Cached(next Authenticator, ttl, negativeTTL time.Duration) Authenticator {
+	return &cache{
+		next:        next,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     newLRU(cacheSize),
+		rejected:    newLRU(negativeCacheSize),
+	}
+}
+
+func (c *cache) Authenticate(ctx context.Context, token string) (Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if entry, ok := c.get(key); ok {
+		return entry.identity, entry.err
+	}
+
+	v, err, _ := c.lookups.Do(key, func() (any, error) {
+		// The lookup is shared, so it must not fail because the caller that
+		// happened to start it went away.
+		identity, err := c.next.Authenticate(context.WithoutCancel(ctx), token)
+		switch {
+		case err == nil:
+			c.put(c.entries, key, cacheEntry{identity: identity, expires: time.Now().Add(c.ttl)})
+		case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrForbidden):
+			c.put(c.rejected, key, cacheEntry{err: err, expires: time.Now().Add(c.negativeTTL)})
+		}
+		return identity, err
+	})
+	return v.(Identity), err
+}
+
+func (c *cache) get(key string) (cacheEntry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, entries := range []*lru{c.entries, c.rejected} {
+		if entry, ok := entries.Get(key); ok {
+			if time.Now().After(entry.expires) {
+				entries.Remove(key)
+				return cacheEntry{}, false
+			}
+			return entry, true
+		}
+	}
+	return cacheEntry{}, false
+}
+
+func (c *cache) put(entries *lru, key string, entry cacheEntry) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	// A token is either accepted or rejected, the latest lookup wins.
+	c.entries.Remove(key)
+	c.rejected.Remove(key)
+	entries.Add(key, entry)
+}
+
+// lru holds up to size entries, dropping the least recently used one to
+// make room for another.
+type lru struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry cacheEntry
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) Get(key string) (cacheEntry, bool) {
+	e, ok := l.items[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruItem).entry, true
+}
+
+func (l *lru) Add(key string, entry cacheEntry) {
+	l.items[key] = l.order.PushFront(&lruItem{key: key, entry: entry})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruItem).key)
+	}
+}
+
+func (l *lru) Remove(key string) {
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) Len() int {
+	return l.order.Len()
+}
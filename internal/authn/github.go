@@ -0,0 +1,155 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GitHubAccess restricts the GitHub provider to the members of any of the
+// listed organizations or teams. Everyone with a GitHub account is let in
+// when both are empty. Memberships are checked with the token of the user,
+// which needs the read:org scope to see them.
+type GitHubAccess struct {
+	// APIURL is the GitHub API the memberships are checked with. When empty
+	// auth.GitHubAPIURL is used.
+	APIURL string
+	Orgs   []string
+	// Teams are given as org/team-slug.
+	Teams []string
+}
+
+// Restricted tells whether access is restricted to members of Orgs or Teams.
+func (a GitHubAccess) Restricted() bool {
+	return len(a.Orgs) > 0 || len(a.Teams) > 0
+}
+
+type githubAuthenticator struct {
+	users  auth.GithubUserProvider
+	access GitHubAccess
+}
+
+// GitHub authenticates GitHub access tokens by looking up their user and
+// checking it has access.
+func GitHub(users auth.GithubUserProvider, access GitHubAccess) (Authenticator, error) {
+	for _, team := range access.Teams {
+		if org, slug, ok := strings.Cut(team, "/"); !ok || org == "" || slug == "" {
+			return nil, fmt.Errorf("github team %q is not of the form org/team-slug", team)
+		}
+	}
+	if access.APIURL == "" {
+		access.APIURL = auth.GitHubAPIURL
+	}
+	access.APIURL = strings.TrimSuffix(access.APIURL, "/")
+	return &githubAuthenticator{users: users, access: access}, nil
+}
+
+func (g *githubAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	user, err := g.users(token)
+	if errors.Is(err, auth.ErrBadCredentials) {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	// GitHub keeps to the charset itself, the check guards against stand-ins
+	// of its API that do not.
+	if _, err := checkLogin(user.Login); err != nil {
+		return Identity{}, err
+	}
+	if err := g.authorize(ctx, token, user.Login); err != nil {
+		return Identity{}, err
+	}
+	return Identity{Login: user.Login, Provider: ProviderGitHub}, nil
+}
+
+// authorize checks that login belongs to one of the allowed organizations
+// or teams.
+func (g *githubAuthenticator) authorize(ctx context.Context, token, login string) error {
+	if len(g.access.Orgs) == 0 && len(g.access.Teams) == 0 {
+		return nil
+	}
+
+	var paths, allowed []string
+	for _, org := range g.access.Orgs {
+		paths = append(paths, "/user/memberships/orgs/"+url.PathEscape(org))
+		allowed = append(allowed, "organization "+org)
+	}
+	for _, team := range g.access.Teams {
+		org, slug, _ := strings.Cut(team, "/")
+		paths = append(paths, "/orgs/"+url.PathEscape(org)+"/teams/"+url.PathEscape(slug)+"/memberships/"+url.PathEscape(login))
+		allowed = append(allowed, "team "+team)
+	}
+
+	var missingScope bool
+	for _, path := range paths {
+		status, err := g.membership(ctx, token, path)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case membershipActive:
+			return nil
+		case membershipUnknown:
+			missingScope = true
+		}
+	}
+
+	err := fmt.Errorf("%w: %s is not a member of the GitHub %s", ErrForbidden, login, strings.Join(allowed, " or "))
+	if missingScope {
+		err = fmt.Errorf("%w, run reqbouncer login again to grant access to your organizations", err)
+	}
+	return err
+}
+
+type membershipStatus int
+
+const (
+	membershipNone membershipStatus = iota
+	membershipActive
+	// membershipUnknown is reported when the token may not read the
+	// memberships, usually because it lacks the read:org scope.
+	membershipUnknown
+)
+
+// membership fetches the organization or team membership at path.
+// Pending invitations do not count.
+func (g *githubAuthenticator) membership(ctx context.Context, token, path string) (membershipStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.access.APIURL+path, nil)
+	if err != nil {
+		return membershipNone, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return membershipNone, fmt.Errorf("failed to check github membership: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return membershipNone, nil
+	case http.StatusForbidden:
+		return membershipUnknown, nil
+	default:
+		return membershipNone, fmt.Errorf("failed to check github membership: status %d", resp.StatusCode)
+	}
+
+	var membership struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&membership); err != nil {
+		return membershipNone, fmt.Errorf("failed to decode github membership: %w", err)
+	}
+	if membership.State != "active" {
+		return membershipNone, nil
+	}
+	return membershipActive, nil
+}
@@ -0,0 +1,61 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpClient queries the identity providers.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// gitlab authenticates GitLab personal, project or OAuth access tokens by
+// looking up their user.
+type gitlab struct {
+	url string
+}
+
+// NewGitLab checks tokens against the GitLab instance at url, gitlab.com
+// when empty.
+func NewGitLab(url string) Authenticator {
+	if url == "" {
+		url = "https://gitlab.com"
+	}
+	return &gitlab{url: strings.TrimSuffix(url, "/")}
+}
+
+func (g *gitlab) Authenticate(ctx context.Context, token string) (Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url+"/api/v4/user", nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to get gitlab user: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Identity{}, ErrInvalidToken
+	default:
+		return Identity{}, fmt.Errorf("failed to get gitlab user: status %d", resp.StatusCode)
+	}
+
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return Identity{}, fmt.Errorf("failed to decode gitlab user: %w", err)
+	}
+	login, err := checkLogin(user.Username)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Login: login, Provider: ProviderGitLab}, nil
+}
@@ -0,0 +1,130 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, its endpoints are discovered from
+	// Issuer/.well-known/openid-configuration.
+	Issuer string
+	// ClientID is the audience JWTs have to be issued for, so tokens the
+	// provider issued to other applications are rejected. It is required.
+	ClientID string
+	// ClientSecret switches from validating JWTs against the keys of the
+	// provider to asking its introspection endpoint, authenticated as
+	// ClientID. Introspection also accepts opaque tokens and sees
+	// revocations, at the price of a request per token.
+	ClientSecret string
+	// LoginClaim is the claim holding the login of the user. When empty
+	// preferred_username is used. It has to be stable and unique per user,
+	// values that are not valid logins, such as email addresses, are
+	// denied access.
+	LoginClaim string
+}
+
+// oidcAuthenticator validates tokens issued by an OpenID Connect provider.
+type oidcAuthenticator struct {
+	cfg           OIDCConfig
+	verifier      *oidc.IDTokenVerifier
+	introspection string
+}
+
+// NewOIDC discovers the endpoints of the provider at cfg.Issuer.
+func NewOIDC(ctx context.Context, cfg OIDCConfig) (Authenticator, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("oidc issuer is required")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("oidc client id is required")
+	}
+	if cfg.LoginClaim == "" {
+		cfg.LoginClaim = "preferred_username"
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover oidc provider: %w", err)
+	}
+
+	a := &oidcAuthenticator{cfg: cfg}
+	if cfg.ClientSecret == "" {
+		a.verifier = provider.Verifier(&oidc.Config{ClientID: cfg.ClientID})
+		return a, nil
+	}
+	var endpoints struct {
+		Introspection string `json:"introspection_endpoint"`
+	}
+	if err := provider.Claims(&endpoints); err != nil {
+		return nil, fmt.Errorf("failed to decode oidc discovery: %w", err)
+	}
+	if endpoints.Introspection == "" {
+		return nil, errors.New("oidc provider has no introspection endpoint")
+	}
+	a.introspection = endpoints.Introspection
+	return a, nil
+}
+
+func (a *oidcAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	var claims map[string]any
+	if a.verifier != nil {
+		idToken, err := a.verifier.Verify(ctx, token)
+		if err != nil {
+			return Identity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return Identity{}, fmt.Errorf("failed to decode token claims: %w", err)
+		}
+	} else {
+		var err error
+		if claims, err = a.introspect(ctx, token); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	name, _ := claims[a.cfg.LoginClaim].(string)
+	if name == "" {
+		return Identity{}, fmt.Errorf("%w: no %s claim", ErrInvalidToken, a.cfg.LoginClaim)
+	}
+	login, err := checkLogin(name)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Login: login, Provider: ProviderOIDC}, nil
+}
+
+// introspect asks the provider about token as described in RFC 7662 and
+// returns its claims if it is active.
+func (a *oidcAuthenticator) introspect(ctx context.Context, token string) (map[string]any, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.introspection, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.cfg.ClientID), url.QueryEscape(a.cfg.ClientSecret))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introspect token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to introspect token: status %d", resp.StatusCode)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,453 @@
+package authn
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/google/uuid"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderSession is the provider of identities read from session tokens.
+const ProviderSession = "session"
+
+// DefaultSessionTTL is how long session tokens are valid when Config does
+// not say otherwise.
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// DefaultSessionRecheck is how often the access of the users of sessions is
+// checked again when access is restricted and SessionConfig does not say
+// otherwise.
+const DefaultSessionRecheck = time.Hour
+
+// sessionIssuer tells session tokens apart from the JWTs of an OIDC
+// provider.
+const sessionIssuer = "reqbouncer"
+
+// ErrSessionExpired is returned for session tokens past their expiry.
+var ErrSessionExpired = fmt.Errorf("%w: session expired", ErrInvalidToken)
+
+// Session is a token issued by the server in exchange for a token of the
+// identity provider, so the latter does not have to be kept by clients.
+type Session struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	Login     string    `json:"login"`
+	Provider  string    `json:"provider"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// issuedAt is when the session started, see Sessions.checkAccess.
+	issuedAt time.Time
+}
+
+type sessionClaims struct {
+	jwt.Claims
+	Provider string `json:"provider,omitempty"`
+}
+
+// SessionConfig configures the sessions of NewSessions.
+type SessionConfig struct {
+	// Secret signs the session tokens and has to be shared by every
+	// instance. Without a secret a random key is used, so sessions do not
+	// survive restarts and are only valid on the instance that issued them.
+	Secret string
+	// TTL is how long sessions last. When zero DefaultSessionTTL is used.
+	TTL time.Duration
+	// Recheck is how often the access of the user of a session is checked
+	// again with the provider token the session was started with. When zero
+	// access is only checked when the session starts.
+	Recheck time.Duration
+	// Revocations keeps revoked sessions across restarts. When nil they
+	// only last until the instance restarts.
+	Revocations RevocationStore
+	// Credentials keeps the provider tokens sessions were started with for
+	// rechecking. When nil they are kept in memory, so sessions started on
+	// another instance or before a restart end at their next recheck.
+	Credentials CredentialStore
+}
+
+// RevocationStore keeps the revocations of sessions for the instances
+// starting later.
+type RevocationStore interface {
+	// RevokeSession keeps the session with id revoked until expires.
+	RevokeSession(id string, expires time.Time) error
+	// RevokeLogin keeps the sessions login started until before revoked
+	// until expires.
+	RevokeLogin(login string, before, expires time.Time) error
+	// Revocations returns the expiry of the revoked sessions by ID and when
+	// the sessions of logins were last revoked, leaving out the expired
+	// ones.
+	Revocations() (sessions, logins map[string]time.Time, err error)
+}
+
+// CredentialStore keeps the provider tokens sessions were started with,
+// sealed, for the instances rechecking the access of their users.
+type CredentialStore interface {
+	// StoreCredential keeps credential for the session with id until
+	// expires.
+	StoreCredential(id, credential string, expires time.Time) error
+	// Credential returns the credential of the session with id, or "" when
+	// there is none.
+	Credential(id string) (string, error)
+	// DeleteCredential forgets the credential of the session with id.
+	DeleteCredential(id string) error
+}
+
+// Sessions issues and verifies session tokens. They are JWTs signed with a
+// key shared by the instances of the server, so connects are validated
+// without asking the identity provider. The provider token a session was
+// started with stays on the server, sealed in the CredentialStore, so the
+// access of its user can be checked again every Recheck.
+type Sessions struct {
+	key         []byte
+	sealKey     []byte
+	signer      jose.Signer
+	ttl         time.Duration
+	recheck     time.Duration
+	store       RevocationStore
+	credentials CredentialStore
+
+	// revoked holds the IDs of revoked sessions until they expire anyway,
+	// revokedBefore when all sessions of a login were last revoked and
+	// checked when the access of the users of sessions was last checked.
+	revoked       map[string]time.Time
+	revokedBefore map[string]time.Time
+	checked       map[string]checkedSession
+	mux           sync.Mutex
+}
+
+type checkedSession struct {
+	at      time.Time
+	expires time.Time
+}
+
+// NewSessions returns the sessions configured by cfg, restoring the
+// revocations kept in cfg.Revocations.
+func NewSessions(cfg SessionConfig) (*Sessions, error) {
+	key := []byte(cfg.Secret)
+	switch {
+	case cfg.Secret == "":
+		slog.Warn("no session secret configured, sessions will not survive restarts")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	case len(key) < 32:
+		return nil, errors.New("session secret must be at least 32 bytes long")
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+	// The provider tokens are sealed with a key of their own, so it does
+	// not matter that the signing key is used for HMAC as well, and they
+	// cannot be read from the CredentialStore without it.
+	sealKey := sha256.Sum256(append([]byte("reqbouncer session credential:"), key...))
+	s := &Sessions{
+		key:           key,
+		sealKey:       sealKey[:],
+		signer:        signer,
+		ttl:           cmp.Or(cfg.TTL, DefaultSessionTTL),
+		recheck:       cfg.Recheck,
+		store:         cfg.Revocations,
+		credentials:   cfg.Credentials,
+		revoked:       make(map[string]time.Time),
+		revokedBefore: make(map[string]time.Time),
+		checked:       make(map[string]checkedSession),
+	}
+	if s.store == nil && cfg.Secret != "" {
+		slog.Warn("no store for revoked sessions configured, revocations will not survive restarts")
+	}
+	if s.credentials == nil {
+		if s.recheck > 0 && cfg.Secret != "" {
+			slog.Warn("no store for session credentials configured, sessions will end at their first recheck on other instances or after restarts")
+		}
+		s.credentials = newMemoryCredentials()
+	}
+	if s.store != nil {
+		if s.revoked, s.revokedBefore, err = s.store.Revocations(); err != nil {
+			return nil, fmt.Errorf("failed to restore revoked sessions: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Issue starts a session for id, who authenticated with providerToken.
+func (s *Sessions) Issue(id Identity, providerToken string) (Session, error) {
+	now := time.Now()
+	session := Session{ID: uuid.NewString(), Login: id.Login, Provider: id.Provider, ExpiresAt: now.Add(s.ttl).Truncate(time.Second)}
+	claims := sessionClaims{
+		Claims: jwt.Claims{
+			Issuer:   sessionIssuer,
+			Subject:  id.Login,
+			ID:       session.ID,
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(session.ExpiresAt),
+		},
+		Provider: id.Provider,
+	}
+	token, err := jwt.Signed(s.signer).Claims(claims).Serialize()
+	if err != nil {
+		return Session{}, err
+	}
+	if s.recheck > 0 {
+		credential, err := s.seal(providerToken)
+		if err != nil {
+			return Session{}, err
+		}
+		if err := s.credentials.StoreCredential(session.ID, credential, session.ExpiresAt); err != nil {
+			return Session{}, fmt.Errorf("failed to store session credential: %w", err)
+		}
+	}
+	session.Token = token
+	return session, nil
+}
+
+// seal encrypts token, so only the instances of the server can read it from
+// the CredentialStore.
+func (s *Sessions) seal(token string) (string, error) {
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: s.sealKey}, nil)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := encrypter.Encrypt([]byte(token))
+	if err != nil {
+		return "", err
+	}
+	return sealed.CompactSerialize()
+}
+
+func (s *Sessions) open(credential string) (string, error) {
+	sealed, err := jose.ParseEncrypted(credential, []jose.KeyAlgorithm{jose.DIRECT}, []jose.ContentEncryption{jose.A256GCM})
+	if err != nil {
+		return "", err
+	}
+	token, err := sealed.Decrypt(s.sealKey)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Verify returns the session of token. ok is false when token is not a
+// session token at all.
+func (s *Sessions) Verify(token string) (session Session, ok bool, err error) {
+	parsed, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{jose.HS256})
+	if err != nil {
+		return Session{}, false, nil
+	}
+	var claims sessionClaims
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil || claims.Issuer != sessionIssuer {
+		return Session{}, false, nil
+	}
+
+	if err := parsed.Claims(s.key, &claims); err != nil {
+		return Session{}, true, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: sessionIssuer}, 0); err != nil {
+		if errors.Is(err, jwt.ErrExpired) {
+			return Session{}, true, ErrSessionExpired
+		}
+		return Session{}, true, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.IssuedAt == nil || claims.Expiry == nil || s.isRevoked(claims) {
+		return Session{}, true, fmt.Errorf("%w: session revoked", ErrInvalidToken)
+	}
+	return Session{
+		ID:        claims.ID,
+		Login:     claims.Subject,
+		Provider:  claims.Provider,
+		ExpiresAt: claims.Expiry.Time(),
+		issuedAt:  claims.IssuedAt.Time(),
+	}, true, nil
+}
+
+func (s *Sessions) isRevoked(claims sessionClaims) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.revoked[claims.ID]; ok {
+		return true
+	}
+	before, ok := s.revokedBefore[claims.Subject]
+	return ok && !claims.IssuedAt.Time().After(before)
+}
+
+// Revoke ends the session with id and forgets its credential. The error
+// tells either was not done in the stores, the revocation still applies
+// until the instance restarts.
+func (s *Sessions) Revoke(id string) error {
+	s.mux.Lock()
+	now := time.Now()
+	for revoked, expires := range s.revoked {
+		if now.After(expires) {
+			delete(s.revoked, revoked)
+		}
+	}
+	expires := now.Add(s.ttl)
+	s.revoked[id] = expires
+	s.mux.Unlock()
+
+	err := s.credentials.DeleteCredential(id)
+	if s.store == nil {
+		return err
+	}
+	return errors.Join(s.store.RevokeSession(id, expires), err)
+}
+
+// RevokeLogin ends the sessions login started until before, see Revoke for
+// the error.
+func (s *Sessions) RevokeLogin(login string, before time.Time) error {
+	s.mux.Lock()
+	now := time.Now()
+	for revoked, at := range s.revokedBefore {
+		if now.After(at.Add(s.ttl)) {
+			delete(s.revokedBefore, revoked)
+		}
+	}
+	if before.After(s.revokedBefore[login]) {
+		s.revokedBefore[login] = before
+	}
+	s.mux.Unlock()
+
+	if s.store == nil {
+		return nil
+	}
+	return s.store.RevokeLogin(login, before, before.Add(s.ttl))
+}
+
+// checkAccess checks the access of the user of session again with next once
+// it was last checked Recheck ago, so users losing access, e.g. by leaving
+// a GitHub organization, are locked out within Recheck rather than when
+// their session expires.
+func (s *Sessions) checkAccess(ctx context.Context, next Authenticator, session Session) error {
+	if s.recheck <= 0 {
+		return nil
+	}
+	s.mux.Lock()
+	checked, ok := s.checked[session.ID]
+	s.mux.Unlock()
+	if !ok {
+		checked.at = session.issuedAt
+	}
+	if time.Since(checked.at) < s.recheck {
+		return nil
+	}
+
+	credential, err := s.credentials.Credential(session.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read session credential: %w", err)
+	}
+	if credential == "" {
+		return fmt.Errorf("%w: access cannot be checked again, log in again", ErrSessionExpired)
+	}
+	token, err := s.open(credential)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	id, err := next.Authenticate(ctx, token)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(id.Login, session.Login) {
+		return fmt.Errorf("%w: session of %s started with a token of %s", ErrInvalidToken, session.Login, id.Login)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	for id, checked := range s.checked {
+		if now.After(checked.expires) {
+			delete(s.checked, id)
+		}
+	}
+	s.checked[session.ID] = checkedSession{at: now, expires: session.ExpiresAt}
+	return nil
+}
+
+// Authenticator accepts session tokens and hands every other token to next,
+// so clients still sending a token of the provider keep working. Only
+// sessions started with provider are accepted, logins of different
+// providers name different users.
+func (s *Sessions) Authenticator(next Authenticator, provider string) Authenticator {
+	return &sessionAuthenticator{sessions: s, next: next, provider: provider}
+}
+
+type sessionAuthenticator struct {
+	sessions *Sessions
+	next     Authenticator
+	provider string
+}
+
+func (a *sessionAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	session, ok, err := a.sessions.Verify(token)
+	if !ok {
+		return a.next.Authenticate(ctx, token)
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	if session.Provider != a.provider {
+		return Identity{}, fmt.Errorf("%w: session started with provider %s", ErrInvalidToken, session.Provider)
+	}
+	if !ValidLogin(strings.ToLower(session.Login)) {
+		return Identity{}, fmt.Errorf("%w: invalid login %q", ErrInvalidToken, session.Login)
+	}
+	if err := a.sessions.checkAccess(ctx, a.next, session); err != nil {
+		return Identity{}, err
+	}
+	return Identity{Login: session.Login, Provider: ProviderSession}, nil
+}
+
+// memoryCredentials is the CredentialStore of Sessions configured without
+// one.
+type memoryCredentials struct {
+	credentials map[string]memoryCredential
+	mux         sync.Mutex
+}
+
+type memoryCredential struct {
+	credential string
+	expires    time.Time
+}
+
+func newMemoryCredentials() *memoryCredentials {
+	return &memoryCredentials{credentials: make(map[string]memoryCredential)}
+}
+
+func (m *memoryCredentials) StoreCredential(id, credential string, expires time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := time.Now()
+	for stored, c := range m.credentials {
+		if now.After(c.expires) {
+			delete(m.credentials, stored)
+		}
+	}
+	m.credentials[id] = memoryCredential{credential: credential, expires: expires}
+	return nil
+}
+
+func (m *memoryCredentials) Credential(id string) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	c, ok := m.credentials[id]
+	if !ok || time.Now().After(c.expires) {
+		return "", nil
+	}
+	return c.credential, nil
+}
+
+func (m *memoryCredentials) DeleteCredential(id string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.credentials, id)
+	return nil
+}
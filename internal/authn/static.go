@@ -0,0 +1,69 @@
+package authn
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// static authenticates the tokens listed in a file. Only their hashes are
+// kept, so tokens are looked up without comparing them byte by byte.
+type static struct {
+	logins map[[sha256.Size]byte]string
+}
+
+// NewStatic loads the tokens of path. Every line holds a login and its
+// token separated by whitespace, blank lines and lines starting with # are
+// skipped:
+//
+//	# login token
+//	alice  3f1c9a...
+//	bob    77ab02...
+//
+// Logins are held to the charset of GitHub logins, see ValidLogin. A login
+// may have several tokens. The file is read once, the server has to
+// be restarted to pick up changes.
+func NewStatic(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+
+	s := &static{logins: make(map[[sha256.Size]byte]string)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("token file line %d: want a login and a token", n)
+		}
+		login := strings.ToLower(fields[0])
+		if !ValidLogin(login) {
+			return nil, fmt.Errorf("token file line %d: %q is not a valid login", n, fields[0])
+		}
+		hash := sha256.Sum256([]byte(fields[1]))
+		if other, ok := s.logins[hash]; ok && other != login {
+			return nil, fmt.Errorf("token file line %d: token already assigned to %s", n, other)
+		}
+		s.logins[hash] = login
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *static) Authenticate(_ context.Context, token string) (Identity, error) {
+	login, ok := s.logins[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+	return Identity{Login: login, Provider: ProviderStatic}, nil
+}
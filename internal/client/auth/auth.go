@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gogama/httpx"
+	"github.com/gogama/httpx/request"
 	"github.com/gogama/httpx/retry"
 	"github.com/gogama/httpx/timeout"
 	"github.com/mscno/zerrors"
@@ -42,7 +43,9 @@ func defaultClient() *httpx.Client {
 
 var httpClient = defaultClient()
 
-func GetGithubConfig(url string) (string, error) {
+// serverURL returns the base URL of the reqbouncer server at host:port,
+// served over https on port 443 only.
+func serverURL(url string) (string, error) {
 	url = strings.TrimPrefix(url, "https://")
 	url = strings.TrimPrefix(url, "http://")
 	host, port, err := net.SplitHostPort(url)
@@ -59,7 +62,14 @@ func GetGithubConfig(url string) (string, error) {
 		scheme = "http"
 	}
 
-	url = scheme + "://" + host + ":" + port
+	return scheme + "://" + host + ":" + port, nil
+}
+
+func GetGithubConfig(url string) (string, error) {
+	url, err := serverURL(url)
+	if err != nil {
+		return "", err
+	}
 
 	url = strings.TrimSuffix(url, "/") + "/_config"
 	slog.Debug("getting github config", "url", url)
@@ -81,10 +91,66 @@ func GetGithubConfig(url string) (string, error) {
 	return config.GithubClientId, nil
 }
 
+// Session is a session token issued by the reqbouncer server.
+type Session struct {
+	Token     string    `json:"token"`
+	Login     string    `json:"login"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StartSession exchanges the access token of the identity provider for a
+// session token of the server at url, so the former need not be kept.
+func StartSession(url, accessToken string) (Session, error) {
+	var session Session
+	url, err := serverURL(url)
+	if err != nil {
+		return session, err
+	}
+	r, err := request.NewPlan("POST", url+"/_auth/session", nil)
+	if err != nil {
+		return session, err
+	}
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := defaultClient().Do(r)
+	if err != nil {
+		return session, zerrors.Internal("error starting session", "error", err)
+	}
+	if resp.StatusCode() != http.StatusCreated {
+		return session, zerrors.Internal("unexpected response", "response_code", resp.StatusCode(), "error", string(resp.Body))
+	}
+	if err := json.Unmarshal(resp.Body, &session); err != nil {
+		return session, zerrors.Internal("error unmarshalling session", "error", err)
+	}
+	return session, nil
+}
+
+// EndSession revokes the session of sessionToken on the server at url.
+func EndSession(url, sessionToken string) error {
+	url, err := serverURL(url)
+	if err != nil {
+		return err
+	}
+	r, err := request.NewPlan("DELETE", url+"/_auth/session", nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+sessionToken)
+
+	resp, err := defaultClient().Do(r)
+	if err != nil {
+		return zerrors.Internal("error ending session", "error", err)
+	}
+	if resp.StatusCode() != http.StatusNoContent {
+		return zerrors.Internal("unexpected response", "response_code", resp.StatusCode(), "error", string(resp.Body))
+	}
+	return nil
+}
+
 func Login(ctx context.Context, githubClientId string) (*AccessTokenResponse, error) {
 
 	v := url.Values{
-		"scope":     {"read:user"},
+		"scope":     {"read:user read:org"},
 		"client_id": {githubClientId},
 	}
 
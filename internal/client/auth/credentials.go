@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase
+// credentials are encrypted with.
+const PassphraseEnv = "REQBOUNCER_PASSPHRASE"
+
+// encryptionScheme marks credentials files encrypted with AES-256-GCM under
+// a key derived from a passphrase with scrypt.
+const encryptionScheme = "scrypt-aes256gcm"
+
+// Parameters of scrypt as recommended for interactive logins.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptSalt   = 16
+	scryptKeyLen = 32
+)
+
+// ErrPassphraseRequired is returned when reading encrypted credentials
+// without a passphrase.
+var ErrPassphraseRequired = fmt.Errorf("credentials are encrypted, set %s to the passphrase", PassphraseEnv)
+
+// ErrWrongPassphrase is returned when encrypted credentials do not decrypt
+// with the passphrase given.
+var ErrWrongPassphrase = errors.New("wrong passphrase for credentials")
+
+// Credentials are the secrets the client authenticates to the server with.
+type Credentials struct {
+	AccessToken string
+}
+
+// SaveCredentials writes creds to path, readable by the current user only.
+// Unless passphrase is empty they are encrypted with a key derived from it.
+func SaveCredentials(path string, creds Credentials, passphrase string) error {
+	content := []byte("access_token=" + creds.AccessToken + "\n")
+	if passphrase != "" {
+		var err error
+		if content, err = encrypt(content, passphrase); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so an interrupted login does not
+	// leave the credentials half written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp already restricts the file to the user, Chmod makes sure
+	// of it on every platform.
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadCredentials reads the credentials SaveCredentials wrote to path,
+// decrypting them with passphrase if they are encrypted. A missing file
+// yields empty credentials.
+func LoadCredentials(path, passphrase string) (Credentials, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Credentials{}, nil
+		}
+		return Credentials{}, err
+	}
+	if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		slog.Warn("credentials file is accessible by other users, run chmod 600 on it", slog.String("path", path))
+	}
+
+	values := parseKeyValues(content)
+	if scheme, ok := values["encryption"]; ok {
+		if scheme != encryptionScheme {
+			return Credentials{}, fmt.Errorf("unknown credentials encryption %q", scheme)
+		}
+		if passphrase == "" {
+			return Credentials{}, ErrPassphraseRequired
+		}
+		if content, err = decrypt(values, passphrase); err != nil {
+			return Credentials{}, err
+		}
+		values = parseKeyValues(content)
+	}
+	return Credentials{AccessToken: values["access_token"]}, nil
+}
+
+// CredentialsFromHelper runs helper, a command line like
+// "pass show reqbouncer", in the shell and takes the access token from the
+// first line of its output, so tokens can be kept in a secret store.
+func CredentialsFromHelper(ctx context.Context, helper string) (Credentials, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", helper)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", helper)
+	}
+	// The helper may have to ask for a PIN or passphrase itself.
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("credential helper %q failed: %w", helper, err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	token := strings.TrimSpace(line)
+	if token == "" {
+		return Credentials{}, fmt.Errorf("credential helper %q printed no access token", helper)
+	}
+	return Credentials{AccessToken: token}, nil
+}
+
+// encrypt seals content with a key derived from passphrase and a fresh
+// salt, both of which are stored along with the ciphertext.
+func encrypt(content []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, scryptSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, content, []byte(encryptionScheme))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "encryption=%s\n", encryptionScheme)
+	fmt.Fprintf(&b, "salt=%s\n", base64.StdEncoding.EncodeToString(salt))
+	fmt.Fprintf(&b, "data=%s\n", base64.StdEncoding.EncodeToString(sealed))
+	return b.Bytes(), nil
+}
+
+func decrypt(values map[string]string, passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(values["salt"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed credentials salt: %w", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(values["data"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed credentials data: %w", err)
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed credentials data: too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	content, err := aead.Open(nil, nonce, ciphertext, []byte(encryptionScheme))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return content, nil
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseKeyValues reads the key=value lines of content.
+func parseKeyValues(content []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reqbouncer", "credentials")
+	creds := Credentials{AccessToken: "session-token"}
+
+	if got, err := LoadCredentials(path, ""); err != nil || got.AccessToken != "" {
+		t.Errorf("LoadCredentials() of missing file got = %+v, %v, want none", got, err)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		if err := SaveCredentials(path, creds, ""); err != nil {
+			t.Fatalf("SaveCredentials() error = %v", err)
+		}
+		if info, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+			t.Errorf("credentials file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+		}
+		if got, err := LoadCredentials(path, ""); err != nil || got != creds {
+			t.Errorf("LoadCredentials() got = %+v, %v, want %+v", got, err, creds)
+		}
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		if err := SaveCredentials(path, creds, "correct horse"); err != nil {
+			t.Fatalf("SaveCredentials() error = %v", err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(content), creds.AccessToken) {
+			t.Errorf("encrypted credentials contain the access token in plain text")
+		}
+
+		if got, err := LoadCredentials(path, "correct horse"); err != nil || got != creds {
+			t.Errorf("LoadCredentials() got = %+v, %v, want %+v", got, err, creds)
+		}
+		if _, err := LoadCredentials(path, "battery staple"); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("LoadCredentials() with wrong passphrase error = %v, want ErrWrongPassphrase", err)
+		}
+		if _, err := LoadCredentials(path, ""); !errors.Is(err, ErrPassphraseRequired) {
+			t.Errorf("LoadCredentials() without passphrase error = %v, want ErrPassphraseRequired", err)
+		}
+	})
+}
+
+func TestCredentialsFromHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("helper commands are run with sh")
+	}
+	creds, err := CredentialsFromHelper(context.Background(), "printf 'session-token\\nurl: reqbouncer.znow.dev\\n'")
+	if err != nil || creds.AccessToken != "session-token" {
+		t.Errorf("CredentialsFromHelper() got = %+v, %v, want session-token", creds, err)
+	}
+	if _, err := CredentialsFromHelper(context.Background(), "exit 1"); err == nil {
+		t.Errorf("CredentialsFromHelper() of failing helper succeeded")
+	}
+	if _, err := CredentialsFromHelper(context.Background(), "true"); err == nil {
+		t.Errorf("CredentialsFromHelper() of helper printing nothing succeeded")
+	}
+}
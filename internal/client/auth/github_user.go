@@ -2,26 +2,64 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/gogama/httpx"
 	"github.com/gogama/httpx/request"
+	"github.com/gogama/httpx/retry"
+	"github.com/gogama/httpx/timeout"
 	"github.com/mscno/zerrors"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type GithubUserProvider func(accessToken string) (GitHubUser, error)
 
+// GitHubAPIURL is the API of github.com.
+const GitHubAPIURL = "https://api.github.com"
+
+// ErrBadCredentials is returned for access tokens GitHub rejected.
+var ErrBadCredentials = errors.New("bad github credentials")
+
 func GetGitHubUser(accessToken string) (GitHubUser, error) {
+	return getGitHubUser(httpClient, GitHubAPIURL, accessToken)
+}
+
+// NewGitHubUserProvider looks up users with the GitHub API at apiURL,
+// GitHubAPIURL when empty. It gives up sooner than GetGitHubUser, so a
+// struggling GitHub does not hold up the server's handshakes.
+func NewGitHubUserProvider(apiURL string) GithubUserProvider {
+	if apiURL == "" {
+		apiURL = GitHubAPIURL
+	}
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	client := &httpx.Client{
+		TimeoutPolicy: timeout.Fixed(5 * time.Second),
+		RetryPolicy: retry.NewPolicy(
+			retry.Times(2).And(retry.StatusCode(502, 504).Or(retry.TransientErr)),
+			retry.NewExpWaiter(200*time.Millisecond, time.Second, time.Now()),
+		),
+	}
+	return func(accessToken string) (GitHubUser, error) {
+		return getGitHubUser(client, apiURL, accessToken)
+	}
+}
+
+func getGitHubUser(client *httpx.Client, apiURL, accessToken string) (GitHubUser, error) {
 	var user GitHubUser
-	r, err := request.NewPlan("GET", "https://api.github.com/user", nil)
+	r, err := request.NewPlan("GET", apiURL+"/user", nil)
 	if err != nil {
 		return user, err
 	}
 	r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	result, err := httpClient.Do(r)
+	result, err := client.Do(r)
 	if err != nil {
 		return user, err
 	}
+	if result.StatusCode() == http.StatusUnauthorized {
+		return user, ErrBadCredentials
+	}
 	if result.StatusCode() != http.StatusOK {
 		return user, zerrors.Internal("failed to get github user", "status_code", result.StatusCode())
 	}
@@ -3,11 +3,15 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/lxzan/gws"
 	"github.com/mscno/zerrors"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"github.com/znowdev/reqbouncer/internal/tracing"
 	"github.com/znowdev/reqbouncer/internal/wire"
 	"io"
 	"log/slog"
@@ -17,6 +21,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -43,10 +48,27 @@ type Client struct {
 	connMutex      sync.Mutex
 	path           string
 	target         HostPost
+	routes         routeTable
+	inspectAddr    string
+	inspector      *inspect.Ring
+	metricsAddr    string
+	metrics        *clientMetrics
+	tracing        tracing.Config
+	dumps          *DumpStore
 	server         HostPost
 	accessToken    string
 	clientId       string
+	tunnel         string
+	pool           string
+	offlineStatus  int
+	name           string
+	version        string
+	capabilities   wire.Capabilities
+	codec          wire.Codec
 	closeErr       chan error
+	exchanges      map[string]*exchange
+	cancels        map[string]context.CancelFunc
+	exchangesMux   sync.Mutex
 	reconnectDelay time.Duration
 	maxConnAge     time.Duration
 }
@@ -56,6 +78,37 @@ type Config struct {
 	Server      string
 	Path        string
 	AccessToken string
+	// TCP forwards raw TCP connections from a public port allocated by the
+	// server instead of HTTP requests.
+	TCP bool
+	// Pool shares the subdomain with other clients using the same strategy,
+	// see wire.PoolRoundRobin and wire.PoolLeastInflight.
+	Pool string
+	// Name registers a named tunnel, served next to the user's own
+	// subdomain, so several tunnels can run at once.
+	Name string
+	// Routes send requests matching a path prefix to other targets than
+	// Target, which serves everything else.
+	Routes []Route
+	// Inspect is the address of the local web inspector, e.g. ":4040".
+	// Addresses without a host are bound to 127.0.0.1, use "0.0.0.0:4040"
+	// to reach the inspector from other machines. The inspector is disabled
+	// when empty.
+	Inspect string
+	// Metrics is the address Prometheus metrics are served on, e.g.
+	// ":9091". Metrics are disabled when empty.
+	Metrics string
+	// DumpDir is where proxied requests are stored for replaying them. No
+	// requests are stored when empty.
+	DumpDir string
+	// OfflineQueue asks the server to answer requests with this status code
+	// while the client is disconnected and deliver them once it reconnects.
+	// Requests are not queued when zero.
+	OfflineQueue int
+	// Version is the release of the client reported to the server.
+	Version string
+	// Tracing selects where the spans of forwarded requests are exported.
+	Tracing tracing.Config
 }
 
 const (
@@ -103,14 +156,60 @@ func NewClient(cfg Config) (*Client, error) {
 		return nil, fmt.Errorf("missing access token")
 	}
 
+	tunnel := wire.TunnelHTTP
+	if cfg.TCP {
+		tunnel = wire.TunnelTCP
+	}
+
+	if cfg.Pool != "" && !wire.ValidPoolStrategy(cfg.Pool) {
+		return nil, fmt.Errorf("unknown pool strategy %q, use %s or %s", cfg.Pool, wire.PoolRoundRobin, wire.PoolLeastInflight)
+	}
+	if cfg.Name != "" && !wire.ValidTunnelName(cfg.Name) {
+		return nil, fmt.Errorf("invalid tunnel name %q: use up to 32 lowercase letters, digits and single hyphens", cfg.Name)
+	}
+	if cfg.OfflineQueue != 0 && (cfg.OfflineQueue < 200 || cfg.OfflineQueue > 599) {
+		return nil, fmt.Errorf("invalid offline queue status %d", cfg.OfflineQueue)
+	}
+	if cfg.OfflineQueue != 0 && cfg.TCP {
+		return nil, fmt.Errorf("tcp tunnels cannot queue requests")
+	}
+	if len(cfg.Routes) > 0 && cfg.TCP {
+		return nil, fmt.Errorf("tcp tunnels cannot route by path")
+	}
+	routes, err := newRouteTable(target, cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Pool != "" && cfg.TCP {
+		return nil, fmt.Errorf("tcp tunnels cannot be pooled")
+	}
+
 	slog.Debug(fmt.Sprintf("connecting to %s:%s", server.Host, server.Port))
 
+	var dumps *DumpStore
+	if cfg.DumpDir != "" {
+		dumps = NewDumpStore(cfg.DumpDir, DefaultDumpRetention)
+	}
+
 	return &Client{
-		path:        cfg.Path,
-		target:      target,
-		server:      server,
-		accessToken: cfg.AccessToken,
-		closeErr:    make(chan error),
+		tunnel:        tunnel,
+		pool:          cfg.Pool,
+		offlineStatus: cfg.OfflineQueue,
+		name:          cfg.Name,
+		version:       cfg.Version,
+		inspectAddr:   cfg.Inspect,
+		metricsAddr:   cfg.Metrics,
+		tracing:       cfg.Tracing,
+		dumps:         dumps,
+		path:          cfg.Path,
+		target:        target,
+		routes:        routes,
+		server:        server,
+		accessToken:   cfg.AccessToken,
+		codec:         wire.JSON,
+		closeErr:      make(chan error),
+		exchanges:     make(map[string]*exchange),
+		cancels:       make(map[string]context.CancelFunc),
 	}, nil
 
 }
@@ -130,17 +229,34 @@ func (c *Client) connect(ctx context.Context) error {
 
 	u := url.URL{Scheme: scheme, Host: c.server.Host, Path: c.path}
 
+	requestHeader := map[string][]string{
+		"Authorization":         {"Bearer " + c.accessToken},
+		"reqbouncer-client-id":  {c.clientId},
+		wire.VersionHeader:      {strconv.Itoa(wire.ProtocolVersion)},
+		wire.CapabilitiesHeader: {wire.SupportedCapabilities.String()},
+		wire.TunnelHeader:       {c.tunnel},
+	}
+	if c.pool != "" {
+		requestHeader[wire.PoolHeader] = []string{c.pool}
+	}
+	if c.name != "" {
+		requestHeader[wire.TunnelNameHeader] = []string{c.name}
+	}
+	if c.version != "" {
+		requestHeader[wire.ClientVersionHeader] = []string{c.version}
+	}
+	if c.offlineStatus != 0 {
+		requestHeader[wire.OfflineQueueHeader] = []string{strconv.Itoa(c.offlineStatus)}
+	}
+
 	var conn *gws.Conn
 	var err error
 	var resp *http.Response
 	for i := 0; i < maxRetries; i++ {
 		slog.Debug(fmt.Sprintf("dialing %s", u.String()))
 		conn, resp, err = gws.NewClient(c, &gws.ClientOption{
-			Addr: u.String(),
-			RequestHeader: map[string][]string{
-				"Authorization":        {"Bearer " + c.accessToken},
-				"reqbouncer-client-id": {c.clientId},
-			},
+			Addr:          u.String(),
+			RequestHeader: requestHeader,
 			PermessageDeflate: gws.PermessageDeflate{
 				Enabled:               true,
 				ServerContextTakeover: true,
@@ -158,13 +274,20 @@ func (c *Client) connect(ctx context.Context) error {
 			case http.StatusNotFound:
 				return fmt.Errorf("server not found: " + c.server.Host)
 			case http.StatusConflict:
+				if c.pool != "" {
+					body, _ := io.ReadAll(resp.Body)
+					return fmt.Errorf("cannot join pool for host %s: %s", c.server.Host, body)
+				}
 				return fmt.Errorf("client already connected for host: " + c.server.Host)
+			case http.StatusUpgradeRequired:
+				body, _ := io.ReadAll(resp.Body)
+				return zerrors.FailedPrecondition(fmt.Sprintf("server rejected client protocol version %d: %s", wire.ProtocolVersion, body))
 			case http.StatusUnauthorized:
 				body, _ := io.ReadAll(resp.Body)
-				return zerrors.Unauthenticated(fmt.Sprintf("unauthorized: %s", body))
+				return zerrors.Unauthenticated(fmt.Sprintf("unauthorized: %s", errorMessage(body)))
 			case http.StatusForbidden:
 				body, _ := io.ReadAll(resp.Body)
-				return zerrors.PermissionDenied(fmt.Sprintf("permission denied: %s", body))
+				return zerrors.PermissionDenied(fmt.Sprintf("permission denied: %s", errorMessage(body)))
 			default:
 				return fmt.Errorf("unexpected response: %s", resp.Status)
 			}
@@ -172,13 +295,31 @@ func (c *Client) connect(ctx context.Context) error {
 
 		if err != nil {
 			slog.Debug(fmt.Sprintf("failed to dial, retrying in %s", retryPeriod), slog.Any("error", err))
-			time.Sleep(retryPeriod)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryPeriod):
+			}
 			retryPeriod = retryPeriod * 2
 			continue
 		}
 
 		if err == nil {
+			serverVersion, err := wire.ParseVersion(resp.Header.Get(wire.VersionHeader))
+			if err != nil || serverVersion < wire.MinServerProtocolVersion {
+				conn.NetConn().Close()
+				return zerrors.FailedPrecondition(fmt.Sprintf(
+					"server protocol version %q is no longer supported (client requires %d or newer), please upgrade the server or use an older reqbouncer",
+					resp.Header.Get(wire.VersionHeader), wire.MinServerProtocolVersion))
+			}
 			slog.Info(fmt.Sprintf("successfully connected to %s", c.server.Host))
+			c.capabilities = wire.SupportedCapabilities.Intersect(wire.ParseCapabilities(resp.Header.Get(wire.CapabilitiesHeader)))
+			c.codec = c.capabilities.Codec()
+			slog.Debug(fmt.Sprintf("server speaks protocol version %s, negotiated capabilities: %s", resp.Header.Get(wire.VersionHeader), c.capabilities))
+			if c.tunnel == wire.TunnelTCP && !c.capabilities.Has(wire.CapTCP) {
+				conn.NetConn().Close()
+				return zerrors.FailedPrecondition("server does not support tcp tunnels")
+			}
 			c.conn = conn
 			c.conn.SetDeadline(time.Now().Add(30 * time.Second))
 			break
@@ -188,12 +329,28 @@ func (c *Client) connect(ctx context.Context) error {
 	return err
 }
 
+// errorMessage returns the message of an error response of the server,
+// falling back to the raw body when it is not one of its JSON errors.
+func errorMessage(body []byte) string {
+	var e struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &e); err == nil {
+		if msg := cmp.Or(e.Message, e.Error); msg != "" {
+			return msg
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
 type WebSocket struct {
 }
 
 func (c *Client) OnClose(socket *gws.Conn, err error) {
 	// Start a goroutine to reconnect after ReconnectDelay
 	slog.Debug("connection closed", slog.Any("error", err))
+	c.abortExchanges()
 
 	if strings.Contains(err.Error(), "client already connected") {
 		fmt.Printf("onerror: err=%s\n", err.Error())
@@ -243,43 +400,120 @@ func (c *Client) OnPing(socket *gws.Conn, payload []byte) {
 
 func (c *Client) OnMessage(socket *gws.Conn, wsmsg *gws.Message) {
 	defer wsmsg.Close()
-	if wsmsg.Opcode == gws.OpcodeBinary {
-		if err := c.readAndForwardMessage(wsmsg.Bytes()); err != nil {
-			slog.Error("failed to read and forward message", slog.Any("error", err))
-		}
+	if wsmsg.Opcode != gws.OpcodeBinary {
+		return
+	}
+
+	var wireMessage wire.WireMessage
+	if err := c.codec.Decode(wsmsg.Bytes(), &wireMessage); err != nil {
+		slog.Error("failed to deserialize message", slog.Any("error", err))
+		return
+	}
+
+	if wireMessage.Type == wire.FrameControl {
+		c.handleControl(wireMessage)
+		return
 	}
+	if wireMessage.Type != wire.FrameHTTP {
+		c.handleStreamFrame(wireMessage)
+		return
+	}
+	c.startRequest(wireMessage)
 }
 
 func (c *Client) Listen(ctx context.Context) error {
 	target := c.target
 	server := c.server
 
+	if c.inspectAddr != "" {
+		ln, err := net.Listen("tcp", inspectorListenAddr(c.inspectAddr))
+		if err != nil {
+			return fmt.Errorf("failed to start inspector: %w", err)
+		}
+		defer ln.Close()
+		c.inspector = inspect.NewRing(inspect.DefaultHistory)
+		go c.serveInspector(ln)
+		slog.Info(fmt.Sprintf("inspector available at http://localhost:%d", ln.Addr().(*net.TCPAddr).Port))
+	}
+
+	shutdownTracing, err := tracing.Init(ctx, "reqbouncer-client", c.tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	if c.metricsAddr != "" {
+		ln, err := net.Listen("tcp", c.metricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to serve metrics: %w", err)
+		}
+		defer ln.Close()
+		c.metrics = newClientMetrics()
+		go c.metrics.serve(ln)
+		slog.Info(fmt.Sprintf("metrics available at http://localhost:%d/metrics", ln.Addr().(*net.TCPAddr).Port))
+	}
+
 	slog.Info(fmt.Sprintf("connecting to %s", server.Host))
 	if c.clientId != "" {
 		slog.Info(fmt.Sprintf("using client_id %s", c.clientId))
 	}
 	// Connect to the server
-	err := c.connect(ctx)
+	err = c.connect(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to dial: %w", err)
 	}
 	defer c.conn.NetConn().Close()
+	c.metrics.setConnected(true)
+
+	// Stopping the client closes the connection, which ends the main loop
+	// and aborts the exchanges still running.
+	stop := context.AfterFunc(ctx, func() {
+		c.connMutex.Lock()
+		defer c.connMutex.Unlock()
+		c.conn.WriteClose(1000, []byte("client stopped"))
+	})
+	defer stop()
 
 	// Handle graceful shutdown
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, os.Kill)
 	go handleShutdown(ch, c.conn)
 
-	slog.Info(fmt.Sprintf("forwarding all requests to %s", target.String()))
+	if c.name != "" {
+		slog.Info(fmt.Sprintf("registered tunnel %s at %s", c.name, c.namedHost()))
+	}
+	if c.pool != "" {
+		slog.Info(fmt.Sprintf("sharing the subdomain with other clients using %s", c.pool))
+	}
+	if c.tunnel == wire.TunnelTCP {
+		slog.Info(fmt.Sprintf("forwarding all tcp connections to %s", target.String()))
+	} else {
+		for _, r := range c.routes.routes {
+			slog.Info(fmt.Sprintf("forwarding requests for %s to %s", r.prefix, r.target.String()))
+		}
+		slog.Info(fmt.Sprintf("forwarding all requests to %s", target.String()))
+	}
 
 	// Main loop: read messages and forward requests
 	for {
 		c.conn.ReadLoop()
+		c.metrics.setConnected(false)
+		if ctx.Err() != nil {
+			return nil
+		}
 		slog.Info("connection lost, trying to reconnect...")
 		err = c.connect(ctx)
+		if ctx.Err() != nil {
+			if err == nil {
+				c.conn.NetConn().Close()
+			}
+			return nil
+		}
 		if err != nil {
 			return zerrors.ToInternal(err, "failed to reconnect")
 		}
+		c.metrics.setConnected(true)
+		c.metrics.reconnected()
 		continue
 		//slog.Debug("connection closed, waiting for close error")
 		//err = <-c.closeErr
@@ -294,8 +528,6 @@ func (c *Client) Listen(ctx context.Context) error {
 		//}
 		//break
 	}
-
-	return err
 }
 
 func handleShutdown(c chan os.Signal, conn *gws.Conn) {
@@ -309,35 +541,91 @@ func handleShutdown(c chan os.Signal, conn *gws.Conn) {
 	os.Exit(0)
 }
 
-func (c *Client) readAndForwardMessage(socketPayload []byte) error {
+// namedHost returns the public host of the client's named tunnel. The
+// configured server host starts with the user's login.
+func (c *Client) namedHost() string {
+	login, rest, found := strings.Cut(c.server.Host, ".")
+	if !found {
+		return c.server.Host
+	}
+	return wire.NamedSubdomain(c.name, login) + "." + rest
+}
 
-	var wireMessage wire.WireMessage
-	if err := wireMessage.Deserialize(socketPayload); err != nil {
-		slog.Error("failed to deserialize message", slog.Any("error", err))
+// handleControl acts on a control frame sent by the server.
+func (c *Client) handleControl(frame wire.WireMessage) {
+	ctrl, err := wire.ParseControl(frame.Payload)
+	if err != nil {
+		slog.Error("failed to parse control frame", slog.Any("error", err))
+		return
+	}
+	switch ctrl.Kind {
+	case wire.ControlTCPListener:
+		host, _, _ := strings.Cut(c.server.Host, ":")
+		slog.Info(fmt.Sprintf("tcp tunnel available at tcp://%s:%d", host, ctrl.Port))
+	case wire.ControlGoingAway:
+		// The server closes the connection next, the main loop reconnects.
+		slog.Info("server is going away, reconnecting", slog.String("reason", ctrl.Reason))
+	default:
+		slog.Debug("ignoring unknown control frame", slog.Any("kind", ctrl.Kind))
+	}
+}
+
+// prepareRequest points a request received from the server at the target
+// routed for its path and returns that target.
+func (c *Client) prepareRequest(req *http.Request) HostPost {
+	target := c.routes.Target(req.URL.Path)
+	req.RequestURI = ""
+	req.URL.Scheme = target.HttpScheme()
+	req.URL.Host = target.String()
+
+	slog.Info(fmt.Sprintf("forwarding request to %s: %s %s", target.String(), req.Method, req.URL.Path))
+	return target
+}
+
+// writeFrame encodes w with the negotiated codec and sends it to the server.
+func (c *Client) writeFrame(w wire.WireMessage) error {
+	wirePayload, err := c.codec.Encode(w)
+	if err != nil {
+		slog.Error("failed to serialize response", slog.Any("error", err))
 		return err
 	}
 
+	return c.conn.WriteMessage(gws.OpcodeBinary, wirePayload)
+}
+
+// readAndForwardMessage sends the request carried by wireMessage to the
+// target and its response back to the server, unless ctx is cancelled first.
+func (c *Client) readAndForwardMessage(ctx context.Context, wireMessage wire.WireMessage) error {
 	buf := bufio.NewReader(bytes.NewReader(wireMessage.Payload))
 	req, err := http.ReadRequest(buf)
 	if err != nil {
 		slog.Error("failed to read request", slog.Any("error", err))
 		return err
 	}
-	req.RequestURI = ""
-	req.URL.Scheme = c.target.HttpScheme()
-	req.URL.Host = c.target.String()
-
-	slog.Info(fmt.Sprintf("forwarding request to %s: %s %s", c.target.String(), req.Method, req.URL.Path))
+	rec := c.newRecording(wireMessage.ID)
+	rec.Request(req)
+	target := c.prepareRequest(req)
+	rec.Target(target)
 
+	ctx, req, span := startTargetSpan(ctx, req, target)
 	resp, err := http.DefaultClient.Do(req)
+	endTargetSpan(span, resp, err)
 	if err != nil {
+		if ctx.Err() != nil {
+			// Nobody is waiting for the response anymore.
+			rec.Finish(ctx.Err())
+			return nil
+		}
 		slog.Error("failed to send request", slog.Any("error", err))
+		rec.Finish(err)
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusSwitchingProtocols {
 		slog.Info("websocket forwarding is not supported")
 		resp = internalErrorHttpResp(errors.New("switching protocols not supported"))
 	}
+	rec.Response(resp)
 	//if resp.StatusCode >= 400 {
 	//	slog.Error("received bad response", slog.Any("response", resp.StatusCode), slog.String("destination", c.target.String()), slog.Any("request", req.URL.String()),
 	//		slog.Any("response", resp.StatusCode), slog.Any("body", printBody(resp)))
@@ -345,29 +633,41 @@ func (c *Client) readAndForwardMessage(socketPayload []byte) error {
 	//}
 
 	respbytes, err := httputil.DumpResponse(resp, true)
+	if ctx.Err() != nil {
+		rec.Finish(ctx.Err())
+		return nil
+	}
 	if err != nil {
 		slog.Error("failed to dump response", slog.Any("error", err))
+		rec.Finish(err)
 		return err
 	}
 
-	responseWireMessage := wire.WireMessage{
+	_, span = tracer.Start(ctx, "reqbouncer.respond")
+	err = c.writeFrame(wire.WireMessage{
 		ID:      wireMessage.ID,
 		Payload: respbytes,
-	}
-
-	wirePayload, err := responseWireMessage.Serialize()
-	if err != nil {
-		slog.Error("failed to serialize response", slog.Any("error", err))
-		return err
-	}
-
-	return c.conn.WriteMessage(gws.OpcodeBinary, wirePayload)
+	})
+	tracing.End(span, 0, err)
+	rec.Finish(err)
+	return err
 }
 
 func internalErrorHttpResp(err error) *http.Response {
+	return errorHttpResp(http.StatusInternalServerError, err)
+}
+
+func errorHttpResp(statusCode int, err error) *http.Response {
+	body := err.Error()
 	return &http.Response{
-		StatusCode: http.StatusInternalServerError,
-		Body:       io.NopCloser(strings.NewReader(err.Error())),
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
 	}
 }
 
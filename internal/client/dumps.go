@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDumpRetention is the number of dumps a DumpStore keeps before
+// deleting the oldest ones.
+const DefaultDumpRetention = 100
+
+// maxDumpBody is the largest request or response body persisted. Exchanges
+// with larger bodies are not stored, as they could not be replayed as is.
+const maxDumpBody = 10 * 1024 * 1024
+
+var dumpIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// Dump is a raw request proxied by the client and the response the target
+// sent back. Headers carrying credentials are redacted before it is stored,
+// see redactHeader.
+type Dump struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	Request  []byte    `json:"request"`
+	Response []byte    `json:"response,omitempty"`
+}
+
+// DumpStore persists dumps in a directory, as a JSON file per request with
+// the raw request and response stored next to it.
+type DumpStore struct {
+	dir  string
+	keep int
+}
+
+func NewDumpStore(dir string, keep int) *DumpStore {
+	if keep <= 0 {
+		keep = DefaultDumpRetention
+	}
+	return &DumpStore{dir: dir, keep: keep}
+}
+
+func (s *DumpStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// messagePaths returns where the raw request and response of id are stored.
+func (s *DumpStore) messagePaths(id string) (request, response string) {
+	return filepath.Join(s.dir, id+".request"), filepath.Join(s.dir, id+".response")
+}
+
+// Save writes d and deletes the oldest dumps beyond the retention.
+func (s *DumpStore) Save(d Dump) error {
+	var response io.Reader
+	if d.Response != nil {
+		response = bytes.NewReader(d.Response)
+	}
+	return s.save(d, bytes.NewReader(d.Request), response)
+}
+
+// save writes the dump d made of the raw messages read from request and
+// response, which is nil when the target never responded. The messages of
+// d itself are ignored.
+func (s *DumpStore) save(d Dump, request, response io.Reader) error {
+	if !dumpIDPattern.MatchString(d.ID) {
+		return fmt.Errorf("invalid request id %q", d.ID)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	requestPath, responsePath := s.messagePaths(d.ID)
+	if err := writeFile(requestPath, request); err != nil {
+		return err
+	}
+	if response != nil {
+		if err := writeFile(responsePath, response); err != nil {
+			return err
+		}
+	}
+	// The JSON file is written last, so only complete dumps are listed.
+	data, err := json.Marshal(Dump{ID: d.ID, Time: d.Time, Target: d.Target})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path(d.ID), data, 0600); err != nil {
+		return err
+	}
+	return s.prune()
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load reads the dump stored for id.
+func (s *DumpStore) Load(id string) (Dump, error) {
+	if !dumpIDPattern.MatchString(id) {
+		return Dump{}, fmt.Errorf("invalid request id %q", id)
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Dump{}, fmt.Errorf("no stored request with id %s", id)
+	}
+	if err != nil {
+		return Dump{}, err
+	}
+	var d Dump
+	if err := json.Unmarshal(data, &d); err != nil {
+		return Dump{}, err
+	}
+
+	// Dumps stored before the messages were kept in files of their own
+	// carry them in the JSON file.
+	requestPath, responsePath := s.messagePaths(id)
+	if d.Request, err = readFile(requestPath, d.Request); err != nil {
+		return Dump{}, err
+	}
+	if d.Response, err = readFile(responsePath, d.Response); err != nil {
+		return Dump{}, err
+	}
+	return d, nil
+}
+
+// readFile returns the content of path, or fallback if there is no such
+// file.
+func readFile(path string, fallback []byte) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fallback, nil
+	}
+	return data, err
+}
+
+// List returns the stored dumps, newest first.
+func (s *DumpStore) List() ([]Dump, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	dumps := make([]Dump, 0, len(ids))
+	for _, id := range ids {
+		d, err := s.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		dumps = append(dumps, d)
+	}
+	return dumps, nil
+}
+
+// ids returns the ids of the stored dumps, newest first.
+func (s *DumpStore) ids() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		id      string
+		modTime time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{id: id, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.id
+	}
+	return ids, nil
+}
+
+func (s *DumpStore) prune() error {
+	ids, err := s.ids()
+	if err != nil || len(ids) <= s.keep {
+		return err
+	}
+	for _, id := range ids[s.keep:] {
+		requestPath, responsePath := s.messagePaths(id)
+		for _, path := range []string{s.path(id), requestPath, responsePath} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// redactedValue replaces the values of the headers removed from dumps.
+const redactedValue = "[redacted]"
+
+// redactHeader returns a copy of h with the values of the headers carrying
+// credentials replaced, so they do not end up on disk. The headers are kept
+// so a replay shows which ones need to be passed again with -H.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for name, values := range h {
+		if !sensitiveHeader(name) {
+			continue
+		}
+		for i := range values {
+			values[i] = redactedValue
+		}
+	}
+	return h
+}
+
+// sensitiveHeader reports whether the header name usually carries
+// credentials, such as tokens, cookies or webhook signatures.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	for _, part := range []string{"signature", "token", "secret", "api-key", "apikey", "password"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+//go:embed inspector.html
+var inspectorPage []byte
+
+// inspectorListenAddr binds addr to the loopback interface when it names no
+// host, as the inspector shows the requests and responses in full.
+func inspectorListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// serveInspector serves the web inspector listing the exchanges proxied by
+// the client on ln, with new ones pushed to the page as they complete.
+func (c *Client) serveInspector(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(inspectorPage)
+	})
+	mux.HandleFunc("GET /api/requests", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"requests": c.inspector.List()})
+	})
+	mux.HandleFunc("GET /api/events", c.inspectorEvents)
+
+	if err := http.Serve(ln, mux); err != nil {
+		slog.Error("inspector stopped", slog.Any("error", err))
+	}
+}
+
+// inspectorEvents streams every new exchange to the page as a server-sent
+// event.
+func (c *Client) inspectorEvents(w http.ResponseWriter, r *http.Request) {
+	exchanges, unsubscribe := c.inspector.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ex := <-exchanges:
+			data, err := json.Marshal(ex)
+			if err != nil {
+				slog.Error("failed to encode exchange", slog.Any("error", err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// clientMetrics are the Prometheus metrics of a forwarding client. A nil
+// clientMetrics records nothing, so callers need not check whether metrics
+// are enabled.
+type clientMetrics struct {
+	registry   *prometheus.Registry
+	requests   *prometheus.CounterVec
+	latency    prometheus.Histogram
+	bytes      *prometheus.CounterVec
+	connected  prometheus.Gauge
+	reconnects prometheus.Counter
+}
+
+func newClientMetrics() *clientMetrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m := &clientMetrics{
+		registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reqbouncer_client_requests_total",
+			Help: "Requests forwarded to the target, by response status code, 0 when it did not respond.",
+		}, []string{"code"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "reqbouncer_client_target_latency_seconds",
+			Help:    "Time from receiving a request from the server until its response was sent back.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reqbouncer_client_bytes_total",
+			Help: "Body bytes forwarded, in for requests and out for responses.",
+		}, []string{"direction"}),
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reqbouncer_client_connected",
+			Help: "Whether the client is connected to the server.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reqbouncer_client_reconnects_total",
+			Help: "Reconnections to the server after the connection was lost.",
+		}),
+	}
+	registry.MustRegister(m.requests, m.latency, m.bytes, m.connected, m.reconnects)
+	return m
+}
+
+// serve exposes the metrics on /metrics until ln is closed.
+func (m *clientMetrics) serve(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	_ = http.Serve(ln, mux)
+}
+
+func (m *clientMetrics) forwarded(status int, latency time.Duration, in, out int64) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(strconv.Itoa(status)).Inc()
+	m.latency.Observe(latency.Seconds())
+	m.bytes.WithLabelValues("in").Add(float64(in))
+	m.bytes.WithLabelValues("out").Add(float64(out))
+}
+
+func (m *clientMetrics) setConnected(connected bool) {
+	if m == nil {
+		return
+	}
+	if connected {
+		m.connected.Set(1)
+	} else {
+		m.connected.Set(0)
+	}
+}
+
+func (m *clientMetrics) reconnected() {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc()
+}
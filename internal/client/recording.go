@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bytes"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recording collects an exchange proxied by the client for the inspector,
+// the dump store and the metrics. A nil recording records nothing, so
+// callers need not check whether any is enabled.
+type recording struct {
+	ring     *inspect.Ring
+	dumps    *DumpStore
+	metrics  *clientMetrics
+	target   string
+	ex       inspect.Exchange
+	reqBody  inspect.Body
+	respBody inspect.Body
+	// The full request and response are only kept for the dump store.
+	req         *http.Request
+	resp        *http.Response
+	rawReqBody  *dumpBody
+	rawRespBody *dumpBody
+}
+
+func (c *Client) newRecording(id string) *recording {
+	if c.inspector == nil && c.dumps == nil && c.metrics == nil {
+		return nil
+	}
+	r := &recording{ring: c.inspector, dumps: c.dumps, metrics: c.metrics, ex: inspect.Exchange{ID: id, Time: time.Now()}}
+	if c.dumps != nil {
+		r.rawReqBody, r.rawRespBody = newDumpBody(), newDumpBody()
+	}
+	return r
+}
+
+// Request records req and tees its body as the target reads it.
+func (r *recording) Request(req *http.Request) {
+	if r == nil {
+		return
+	}
+	r.ex.Method = req.Method
+	r.ex.Path = req.URL.RequestURI()
+	r.ex.RequestHeader = req.Header.Clone()
+	r.req = req.Clone(req.Context())
+	req.Body = teeBody(req.Body, &r.reqBody, r.rawReqBody)
+}
+
+// Target records where the request was forwarded to.
+func (r *recording) Target(target HostPost) {
+	if r == nil {
+		return
+	}
+	r.target = target.String()
+}
+
+// Response records resp and tees its body as it is sent back.
+func (r *recording) Response(resp *http.Response) {
+	if r == nil {
+		return
+	}
+	r.ex.Status = resp.StatusCode
+	r.ex.ResponseHeader = resp.Header.Clone()
+	r.resp = resp
+	resp.Body = teeBody(resp.Body, &r.respBody, r.rawRespBody)
+}
+
+// Finish adds the exchange to the inspector history and the dump store. err
+// is the reason the response could not be delivered, if any.
+func (r *recording) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.ex.Latency = time.Since(r.ex.Time)
+	r.ex.RequestBody, r.ex.RequestTruncated = r.reqBody.Bytes()
+	r.ex.ResponseBody, r.ex.ResponseTruncated = r.respBody.Bytes()
+	if err != nil {
+		r.ex.Error = err.Error()
+	}
+	if r.ring != nil {
+		r.ring.Add(r.ex)
+	}
+	r.metrics.forwarded(r.ex.Status, r.ex.Latency, r.reqBody.Size(), r.respBody.Size())
+	if r.dumps != nil {
+		r.saveDump()
+	}
+}
+
+func (r *recording) saveDump() {
+	defer r.rawReqBody.Close()
+	defer r.rawRespBody.Close()
+	reqBody, reqSize, ok := r.rawReqBody.Reader()
+	respBody, respSize, respOk := r.rawRespBody.Reader()
+	if r.req == nil || !ok || !respOk {
+		return
+	}
+
+	// The heads are dumped without their bodies, which are streamed from
+	// the spooled files instead of being held in memory.
+	req := r.req
+	req.Header = redactHeader(req.Header)
+	req.Header.Del("Content-Length")
+	if reqSize > 0 {
+		req.Header.Set("Content-Length", strconv.FormatInt(reqSize, 10))
+	}
+	req.TransferEncoding = nil
+	reqHead, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		slog.Error("failed to dump request", slog.Any("error", err))
+		return
+	}
+
+	var response io.Reader
+	if r.resp != nil {
+		resp := *r.resp
+		resp.Header = redactHeader(resp.Header)
+		resp.ContentLength = respSize
+		resp.TransferEncoding = nil
+		respHead, err := httputil.DumpResponse(&resp, false)
+		if err != nil {
+			slog.Error("failed to dump response", slog.Any("error", err))
+			return
+		}
+		response = io.MultiReader(bytes.NewReader(respHead), respBody)
+	}
+
+	d := Dump{ID: r.ex.ID, Time: r.ex.Time, Target: r.target}
+	err = r.dumps.save(d, io.MultiReader(bytes.NewReader(reqHead), reqBody), response)
+	if err != nil {
+		slog.Error("failed to store request", slog.Any("error", err))
+	}
+}
+
+// dumpBody spools a whole body to a temporary file for the dump store as it
+// streams, giving up once it grows past maxDumpBody.
+type dumpBody struct {
+	file     *os.File
+	size     int64
+	overflow bool
+	mux      sync.Mutex
+}
+
+// newDumpBody returns a dumpBody spooling to a new temporary file, or one
+// keeping nothing if the file cannot be created.
+func newDumpBody() *dumpBody {
+	file, err := os.CreateTemp("", "reqbouncer-body-*")
+	if err != nil {
+		slog.Error("failed to spool body for the dump store", slog.Any("error", err))
+		return &dumpBody{overflow: true}
+	}
+	return &dumpBody{file: file}
+}
+
+func (b *dumpBody) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.size+int64(len(p)) > maxDumpBody {
+		b.overflow = true
+		return len(p), nil
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	if err != nil {
+		slog.Error("failed to spool body for the dump store", slog.Any("error", err))
+		b.overflow = true
+	}
+	return len(p), nil
+}
+
+// Reader returns the spooled body and its size, or false if it was too
+// large to keep.
+func (b *dumpBody) Reader() (io.Reader, int64, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.overflow {
+		return nil, 0, false
+	}
+	return io.NewSectionReader(b.file, 0, b.size), b.size, true
+}
+
+// Close removes the spooled body. Writes after Close are dropped.
+func (b *dumpBody) Close() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.overflow = true
+	if b.file == nil {
+		return nil
+	}
+	file := b.file
+	b.file = nil
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func teeBody(body io.ReadCloser, w *inspect.Body, raw *dumpBody) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	var dst io.Writer = w
+	if raw != nil {
+		dst = io.MultiWriter(w, raw)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, dst), body}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// dialTarget opens a raw connection to target. TCP tunnels are relayed as
+// is, other streams speak HTTP and use TLS for https targets.
+func (c *Client) dialTarget(ctx context.Context, target HostPost) (net.Conn, error) {
+	if c.tunnel != wire.TunnelTCP && target.HttpScheme() == "https" {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: target.Host}}
+		return dialer.DialContext(ctx, "tcp", target.String())
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", target.String())
+}
+
+// relayStream replays the upgrade request carried by open against the target
+// and pipes the raw connection through the tunnel until either side closes
+// it. The target's handshake response is relayed like any other data. TCP
+// tunnel streams open without a request and are piped from the start.
+// Cancelling ctx, which happens when the connection to the server is lost or
+// the client stops, closes the stream as well.
+func (c *Client) relayStream(ctx context.Context, id string, open wire.WireMessage, frames <-chan wire.WireMessage) {
+	writer := &streamWriter{client: c, id: id}
+
+	target := c.target
+	var req *http.Request
+	if len(open.Payload) > 0 {
+		if r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(open.Payload))); err == nil {
+			req = r
+			target = c.routes.Target(req.URL.Path)
+		}
+	}
+
+	conn, err := c.dialTarget(ctx, target)
+	if err == nil && len(open.Payload) > 0 {
+		if req != nil {
+			slog.Info(fmt.Sprintf("forwarding stream to %s: %s %s", target.String(), req.Method, req.URL.Path))
+		}
+		_, err = conn.Write(open.Payload)
+	} else if err == nil {
+		slog.Info(fmt.Sprintf("forwarding tcp connection to %s", target.String()))
+	}
+	if err != nil {
+		slog.Error("failed to open stream to target", slog.Any("error", err))
+		if conn != nil {
+			conn.Close()
+		}
+		go drainFrames(frames)
+		if len(open.Payload) > 0 {
+			if dump, err := httputil.DumpResponse(errorHttpResp(http.StatusBadGateway, err), true); err == nil {
+				_ = writer.Send(wire.FrameData, dump)
+			}
+		}
+		_ = writer.Send(wire.FrameClose, []byte(err.Error()))
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Frames arriving after the target connection is closed are dropped
+	// until the server closes the stream too.
+	go func() {
+		defer conn.Close()
+		for frame := range frames {
+			switch frame.Type {
+			case wire.FrameData:
+				_, _ = conn.Write(frame.Payload)
+			case wire.FrameClose:
+				return
+			}
+		}
+	}()
+
+	var reason []byte
+	buf := make([]byte, wire.ChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := writer.Send(wire.FrameData, buf[:n]); err != nil {
+				slog.Error("failed to write stream data", slog.Any("error", err))
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				reason = []byte(err.Error())
+			}
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		// The connection to the server is gone or the exchange was
+		// cancelled by it, there is no one left to tell.
+		return
+	}
+
+	if err := writer.Send(wire.FrameClose, reason); err != nil {
+		slog.Error("failed to write stream close", slog.Any("error", err))
+	}
+}
+
+func drainFrames(frames <-chan wire.WireMessage) {
+	for range frames {
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// ReplayOptions edits a stored request before it is replayed.
+type ReplayOptions struct {
+	// Target overrides the target the request was originally forwarded to.
+	Target string
+	// Header replaces the request headers of the same name. An empty value
+	// removes the header.
+	Header http.Header
+	// Body replaces the request body when not nil.
+	Body []byte
+}
+
+// Replay sends the stored request d to its target again. It returns the
+// response and a unified diff against the response originally recorded,
+// which is empty if both are the same.
+func Replay(d Dump, opts ReplayOptions) ([]byte, string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(d.Request)))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read stored request: %w", err)
+	}
+
+	targetAddr := d.Target
+	if opts.Target != "" {
+		targetAddr = opts.Target
+	}
+	target, err := splitHostPort(targetAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	req.RequestURI = ""
+	req.URL.Scheme = target.HttpScheme()
+	req.URL.Host = target.String()
+
+	for k, v := range opts.Header {
+		if len(v) == 0 || (len(v) == 1 && v[0] == "") {
+			req.Header.Del(k)
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if opts.Body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(opts.Body))
+		req.ContentLength = int64(len(opts.Body))
+		req.TransferEncoding = nil
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	replayed, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(comparableResponse(d.Response)),
+		B:        difflib.SplitLines(comparableResponse(replayed)),
+		FromFile: "original",
+		ToFile:   "replay",
+		Context:  3,
+	})
+	return replayed, diff, err
+}
+
+// comparableResponse normalizes a response dump for diffing, dropping the
+// headers that differ on every response.
+func comparableResponse(dump []byte) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(strings.ReplaceAll(string(dump), "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.ToLower(line), "date:") {
+			continue
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
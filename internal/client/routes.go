@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route sends requests whose path starts with Prefix to Target instead of
+// the client's default target. Paths are forwarded unchanged.
+type Route struct {
+	Prefix string
+	Target string
+}
+
+// ParseRoute parses a route written as "/api=localhost:8080". A bare port
+// as target means a port on localhost.
+func ParseRoute(s string) (Route, error) {
+	prefix, target, found := strings.Cut(s, "=")
+	prefix, target = strings.TrimSpace(prefix), strings.TrimSpace(target)
+	if !found || target == "" {
+		return Route{}, fmt.Errorf("invalid route %q, expected /prefix=host:port", s)
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return Route{}, fmt.Errorf("invalid route %q, the prefix must start with /", s)
+	}
+	if _, err := strconv.Atoi(target); err == nil {
+		target = "localhost:" + target
+	}
+	return Route{Prefix: prefix, Target: target}, nil
+}
+
+type route struct {
+	prefix string
+	target HostPost
+}
+
+// routeTable picks the target of a request by the longest matching path
+// prefix, falling back to the default target.
+type routeTable struct {
+	routes        []route
+	defaultTarget HostPost
+}
+
+func newRouteTable(defaultTarget HostPost, routes []Route) (routeTable, error) {
+	table := routeTable{defaultTarget: defaultTarget}
+	for _, r := range routes {
+		target, err := splitHostPort(r.Target)
+		if err != nil {
+			return routeTable{}, fmt.Errorf("invalid target for route %s: %w", r.Prefix, err)
+		}
+		table.routes = append(table.routes, route{prefix: r.Prefix, target: target})
+	}
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		return len(table.routes[i].prefix) > len(table.routes[j].prefix)
+	})
+	return table, nil
+}
+
+// Target returns the target serving path. Prefixes match whole path
+// segments, so /api matches /api and /api/users but not /apis.
+func (t routeTable) Target(path string) HostPost {
+	for _, r := range t.routes {
+		if matchesPrefix(path, r.prefix) {
+			return r.target
+		}
+	}
+	return t.defaultTarget
+}
+
+func matchesPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/znowdev/reqbouncer/internal/tracing"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+)
+
+// exchangeBuffer is the number of in-order frames queued per exchange before
+// the websocket read loop blocks on a slow target.
+const exchangeBuffer = 16
+
+var errExchangeAborted = errors.New("connection to server lost")
+
+// streamWriter sends the frames of one stream direction to the server with
+// increasing seq numbers.
+type streamWriter struct {
+	client *Client
+	id     string
+	seq    uint32
+}
+
+func (w *streamWriter) Send(frameType wire.FrameType, payload []byte) error {
+	err := w.client.writeFrame(wire.WireMessage{ID: w.id, Type: frameType, Seq: w.seq, Payload: payload})
+	w.seq++
+	return err
+}
+
+// exchange is a streamed request whose body is still arriving from the
+// server. Frames are reordered by seq and handed to the goroutine forwarding
+// the request through frames.
+type exchange struct {
+	seq    wire.Sequencer
+	frames chan wire.WireMessage
+}
+
+// handleStreamFrame routes a streamed or raw stream frame to the exchange it
+// belongs to, starting a new exchange on its first frame. It is only called
+// from the websocket read loop.
+func (c *Client) handleStreamFrame(frame wire.WireMessage) {
+	if frame.Type == wire.FrameCancel {
+		c.cancelExchange(frame.ID)
+		return
+	}
+
+	c.exchangesMux.Lock()
+	ex, ok := c.exchanges[frame.ID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		ex = &exchange{frames: make(chan wire.WireMessage, exchangeBuffer)}
+		c.exchanges[frame.ID] = ex
+		c.cancels[frame.ID] = cancel
+		go c.runExchange(ctx, frame.ID, ex.frames)
+	}
+	ready, err := ex.seq.Push(frame)
+	if err != nil {
+		slog.Error("aborting exchange", slog.String("request_id", frame.ID), slog.Any("error", err))
+		close(ex.frames)
+		delete(c.exchanges, frame.ID)
+		if cancel, ok := c.cancels[frame.ID]; ok {
+			cancel()
+		}
+		c.exchangesMux.Unlock()
+		return
+	}
+	if len(ready) > 0 && ready[len(ready)-1].Type.IsFinal() {
+		delete(c.exchanges, frame.ID)
+	}
+	c.exchangesMux.Unlock()
+
+	for _, f := range ready {
+		ex.frames <- f
+		if f.Type.IsFinal() {
+			close(ex.frames)
+		}
+	}
+}
+
+// cancelExchange aborts the target request of a running exchange after the
+// public caller went away.
+func (c *Client) cancelExchange(id string) {
+	c.exchangesMux.Lock()
+	defer c.exchangesMux.Unlock()
+	if cancel, ok := c.cancels[id]; ok {
+		slog.Info("request cancelled by caller", slog.String("request_id", id))
+		cancel()
+	}
+}
+
+// abortExchanges fails every exchange still waiting for frames and cancels
+// running target requests, as their frames and responses cannot cross the
+// tunnel once the connection is gone.
+func (c *Client) abortExchanges() {
+	c.exchangesMux.Lock()
+	defer c.exchangesMux.Unlock()
+	for id, ex := range c.exchanges {
+		close(ex.frames)
+		delete(c.exchanges, id)
+	}
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+}
+
+// startRequest runs a request received as a single FrameHTTP off the read
+// loop, under a context cancelled like that of streamed exchanges.
+func (c *Client) startRequest(frame wire.WireMessage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.exchangesMux.Lock()
+	c.cancels[frame.ID] = cancel
+	c.exchangesMux.Unlock()
+
+	go func() {
+		defer c.releaseExchange(frame.ID)
+		if err := c.readAndForwardMessage(ctx, frame); err != nil {
+			slog.Error("failed to read and forward message", slog.Any("error", err))
+		}
+	}()
+}
+
+// releaseExchange cancels the context of a finished exchange and forgets it.
+func (c *Client) releaseExchange(id string) {
+	c.exchangesMux.Lock()
+	defer c.exchangesMux.Unlock()
+	c.cancels[id]()
+	delete(c.cancels, id)
+}
+
+func (c *Client) runExchange(ctx context.Context, id string, frames <-chan wire.WireMessage) {
+	defer c.releaseExchange(id)
+
+	head, ok := <-frames
+	if !ok {
+		return
+	}
+	if head.Type == wire.FrameOpen {
+		c.relayStream(ctx, id, head, frames)
+		return
+	}
+
+	rec := c.newRecording(id)
+	traceCtx, resp := c.forwardStreamedRequest(ctx, head, frames, rec)
+	defer resp.Body.Close()
+	rec.Response(resp)
+
+	if ctx.Err() != nil {
+		// Nobody is waiting for the response anymore.
+		rec.Finish(ctx.Err())
+		return
+	}
+	_, span := tracer.Start(traceCtx, "reqbouncer.respond")
+	err := c.writeStreamedResponse(ctx, id, resp)
+	tracing.End(span, 0, err)
+	if err != nil {
+		slog.Error("failed to write response", slog.Any("error", err), slog.String("request_id", id))
+	} else {
+		err = ctx.Err()
+	}
+	rec.Finish(err)
+}
+
+// forwardStreamedRequest sends the request described by head to the target,
+// feeding its body from the remaining frames as they arrive. It returns ctx
+// carrying the trace continued from the server along with the response.
+func (c *Client) forwardStreamedRequest(ctx context.Context, head wire.WireMessage, frames <-chan wire.WireMessage, rec *recording) (context.Context, *http.Response) {
+	body, bodyWriter := io.Pipe()
+	go pumpBody(frames, bodyWriter)
+
+	if head.Type != wire.FrameHead {
+		slog.Error("unexpected first frame", slog.Any("frame_type", head.Type))
+		body.Close()
+		return ctx, errorHttpResp(http.StatusBadGateway, errors.New("malformed request stream"))
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head.Payload)))
+	if err != nil {
+		slog.Error("failed to read request", slog.Any("error", err))
+		body.Close()
+		return ctx, errorHttpResp(http.StatusBadGateway, err)
+	}
+	// The transport closes the body once it is done sending it, which may be
+	// after the target started responding.
+	if req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		req.Body = body
+	} else {
+		body.Close()
+		req.Body = http.NoBody
+	}
+	rec.Request(req)
+	target := c.prepareRequest(req)
+	rec.Target(target)
+
+	ctx, req, span := startTargetSpan(ctx, req, target)
+	resp, err := http.DefaultClient.Do(req)
+	endTargetSpan(span, resp, err)
+	if err != nil {
+		slog.Error("failed to send request", slog.Any("error", err))
+		return ctx, errorHttpResp(http.StatusBadGateway, err)
+	}
+	return ctx, resp
+}
+
+// pumpBody copies body frames into w until the stream ends. Frames keep
+// being drained after the target stopped reading so the exchange is freed.
+func pumpBody(frames <-chan wire.WireMessage, w *io.PipeWriter) {
+	for frame := range frames {
+		switch frame.Type {
+		case wire.FrameBody:
+			_, _ = w.Write(frame.Payload)
+		case wire.FrameEnd:
+			if len(frame.Payload) > 0 {
+				w.CloseWithError(errors.New(string(frame.Payload)))
+			} else {
+				w.Close()
+			}
+			return
+		}
+	}
+	w.CloseWithError(errExchangeAborted)
+}
+
+// writeStreamedResponse sends resp back to the server as a FrameHead
+// followed by its body and a closing FrameEnd. Body bytes are forwarded as
+// soon as the target writes them, so event streams and long polls are not
+// held back until a full wire.ChunkSize frame is available.
+func (c *Client) writeStreamedResponse(ctx context.Context, id string, resp *http.Response) error {
+	send := (&streamWriter{client: c, id: id}).Send
+
+	head, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return err
+	}
+	if err := send(wire.FrameHead, head); err != nil {
+		return err
+	}
+
+	buf := make([]byte, wire.ChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if n > 0 {
+			if err := send(wire.FrameBody, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = send(wire.FrameEnd, []byte(err.Error()))
+			return err
+		}
+	}
+
+	return send(wire.FrameEnd, nil)
+}
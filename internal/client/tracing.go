@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+	"github.com/znowdev/reqbouncer/internal/tracing"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+var tracer = otel.Tracer("github.com/znowdev/reqbouncer/internal/client")
+
+// startTargetSpan continues the trace the server propagated in req with a
+// span for the call to target, which is passed on to the target. It returns
+// the continued trace without the target span, for the spans that follow
+// it, and req bound to the target span.
+func startTargetSpan(ctx context.Context, req *http.Request, target HostPost) (context.Context, *http.Request, trace.Span) {
+	ctx = tracing.Extract(ctx, req.Header)
+	targetCtx, span := tracer.Start(ctx, "reqbouncer.target",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ServerAddress(target.Host),
+		))
+	tracing.Inject(targetCtx, req.Header)
+	return ctx, req.WithContext(targetCtx), span
+}
+
+// endTargetSpan ends the span of a target call that returned resp or err.
+func endTargetSpan(span trace.Span, resp *http.Response, err error) {
+	var status int
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	tracing.End(span, status, err)
+}
@@ -11,11 +11,40 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	ReqbouncerHost string `koanf:"reqbouncer_host" validate:"required"`
-	GithubClientId string `koanf:"github_client_id" validate:"required"`
+	ReqbouncerHost     string        `koanf:"reqbouncer_host" validate:"required"`
+	GithubClientId     string        `koanf:"github_client_id" validate:"required"`
+	TCPPortRange       string        `koanf:"tcp_port_range"`
+	InspectHistory     int           `koanf:"inspect_history"`
+	OfflineQueueTTL    time.Duration `koanf:"offline_queue_ttl"`
+	OfflineQueueSize   int           `koanf:"offline_queue_size"`
+	PubSub             string        `koanf:"pubsub" validate:"omitempty,oneof=memory redis nats"`
+	PubSubURL          string        `koanf:"pubsub_url"`
+	AdminLogins        []string      `koanf:"admin_logins"`
+	BlockedLogins      []string      `koanf:"blocked_logins"`
+	MetricsAddr        string        `koanf:"metrics_addr"`
+	TracingExporter    string        `koanf:"tracing_exporter" validate:"omitempty,oneof=otlp stdout"`
+	TracingEndpoint    string        `koanf:"tracing_endpoint"`
+	ShutdownTimeout    time.Duration `koanf:"shutdown_timeout"`
+	MinProtocolVersion int           `koanf:"min_protocol_version"`
+	AuthProvider       string        `koanf:"auth_provider" validate:"omitempty,oneof=github static oidc gitlab"`
+	AuthTokenFile      string        `koanf:"auth_token_file" validate:"required_if=AuthProvider static"`
+	OIDCIssuer         string        `koanf:"oidc_issuer" validate:"required_if=AuthProvider oidc"`
+	OIDCClientID       string        `koanf:"oidc_client_id" validate:"required_if=AuthProvider oidc"`
+	OIDCClientSecret   string        `koanf:"oidc_client_secret"`
+	OIDCLoginClaim     string        `koanf:"oidc_login_claim"`
+	GitLabURL          string        `koanf:"gitlab_url"`
+	GitHubAPIURL       string        `koanf:"github_api_url"`
+	GitHubOrgs         []string      `koanf:"github_orgs"`
+	GitHubTeams        []string      `koanf:"github_teams"`
+	AuthCacheTTL       time.Duration `koanf:"auth_cache_ttl"`
+	AuthNegativeTTL    time.Duration `koanf:"auth_negative_cache_ttl"`
+	SessionSecret      string        `koanf:"session_secret" validate:"omitempty,min=32"`
+	SessionTTL         time.Duration `koanf:"session_ttl"`
+	SessionRecheck     time.Duration `koanf:"session_recheck"`
 }
 
 type BuntConfig struct {
@@ -0,0 +1,234 @@
+// Package inspect records the requests passing through a tunnel so they can
+// be looked at after the fact.
+package inspect
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHistory is the number of exchanges kept per tunnel when no other
+// size is configured.
+const DefaultHistory = 100
+
+// DefaultRetention is how long the history of a tunnel whose clients are
+// gone is kept after its last exchange.
+const DefaultRetention = time.Hour
+
+// BodyLimit is the number of body bytes kept per request and response.
+// Longer bodies are truncated.
+const BodyLimit = 64 * 1024
+
+// Exchange is a recorded request and the response it received.
+type Exchange struct {
+	ID                string        `json:"id"`
+	Time              time.Time     `json:"time"`
+	Method            string        `json:"method"`
+	Path              string        `json:"path"`
+	RequestHeader     http.Header   `json:"request_header"`
+	RequestBody       []byte        `json:"request_body,omitempty"`
+	RequestTruncated  bool          `json:"request_truncated,omitempty"`
+	Status            int           `json:"status"`
+	ResponseHeader    http.Header   `json:"response_header,omitempty"`
+	ResponseBody      []byte        `json:"response_body,omitempty"`
+	ResponseTruncated bool          `json:"response_truncated,omitempty"`
+	Latency           time.Duration `json:"latency"`
+	Error             string        `json:"error,omitempty"`
+}
+
+// Body keeps the first BodyLimit bytes written to it.
+type Body struct {
+	buf       []byte
+	truncated bool
+	size      int64
+	mux       sync.Mutex
+}
+
+// Write never fails, so Body can be teed into without disturbing the
+// stream it records.
+func (b *Body) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.size += int64(len(p))
+	kept := p
+	if room := BodyLimit - len(b.buf); len(kept) > room {
+		b.truncated = true
+		kept = kept[:max(room, 0)]
+	}
+	b.buf = append(b.buf, kept...)
+	return len(p), nil
+}
+
+// Bytes returns the kept bytes and whether any were dropped.
+func (b *Body) Bytes() ([]byte, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return bytes.Clone(b.buf), b.truncated
+}
+
+// Size returns the number of bytes written, including the dropped ones.
+func (b *Body) Size() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.size
+}
+
+// Ring is a bounded history of exchanges. Once full, the oldest exchange is
+// dropped for every new one.
+type Ring struct {
+	items       []Exchange
+	next        int
+	full        bool
+	subscribers map[chan Exchange]struct{}
+	mux         sync.Mutex
+}
+
+// subscriberBuffer is the number of exchanges queued for a subscriber before
+// new ones are dropped for it.
+const subscriberBuffer = 16
+
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	return &Ring{items: make([]Exchange, size), subscribers: make(map[chan Exchange]struct{})}
+}
+
+func (r *Ring) Add(ex Exchange) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.items[r.next] = ex
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+	for ch := range r.subscribers {
+		select {
+		case ch <- ex:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every exchange added from now on,
+// and a function to stop receiving them. Slow subscribers miss exchanges
+// rather than holding up the recording.
+func (r *Ring) Subscribe() (<-chan Exchange, func()) {
+	ch := make(chan Exchange, subscriberBuffer)
+	r.mux.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mux.Unlock()
+	return ch, func() {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		delete(r.subscribers, ch)
+	}
+}
+
+// List returns the recorded exchanges, newest first.
+func (r *Ring) List() []Exchange {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.items)
+	}
+	list := make([]Exchange, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, r.items[(r.next-i+len(r.items))%len(r.items)])
+	}
+	return list
+}
+
+// Get returns the exchange recorded with id.
+func (r *Ring) Get(id string) (Exchange, bool) {
+	for _, ex := range r.List() {
+		if ex.ID == id {
+			return ex, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// Stats sums up every exchange recorded for a tunnel, including those
+// dropped from its history.
+type Stats struct {
+	Requests    int       `json:"requests"`
+	Errors      int       `json:"errors"`
+	LastRequest time.Time `json:"last_request,omitempty"`
+}
+
+func (s *Stats) add(ex Exchange) {
+	s.Requests++
+	if ex.Error != "" || ex.Status >= 500 {
+		s.Errors++
+	}
+	if ex.Time.After(s.LastRequest) {
+		s.LastRequest = ex.Time
+	}
+}
+
+// Store keeps a Ring per tunnel.
+type Store struct {
+	size  int
+	rings map[string]*Ring
+	stats map[string]*Stats
+	mux   sync.Mutex
+}
+
+func NewStore(size int) *Store {
+	return &Store{size: size, rings: make(map[string]*Ring), stats: make(map[string]*Stats)}
+}
+
+func (s *Store) Add(tunnel string, ex Exchange) {
+	s.mux.Lock()
+	ring, ok := s.rings[tunnel]
+	if !ok {
+		ring = NewRing(s.size)
+		s.rings[tunnel] = ring
+		s.stats[tunnel] = &Stats{}
+	}
+	s.stats[tunnel].add(ex)
+	s.mux.Unlock()
+	ring.Add(ex)
+}
+
+// Stats returns the totals of the exchanges recorded for tunnel.
+func (s *Store) Stats(tunnel string) Stats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if stats, ok := s.stats[tunnel]; ok {
+		return *stats
+	}
+	return Stats{}
+}
+
+// List returns the exchanges recorded for tunnel, newest first.
+func (s *Store) List(tunnel string) []Exchange {
+	s.mux.Lock()
+	ring, ok := s.rings[tunnel]
+	s.mux.Unlock()
+	if !ok {
+		return []Exchange{}
+	}
+	return ring.List()
+}
+
+// Evict drops the history and stats of the tunnels whose last exchange is
+// older than before, unless active reports them as still served. It returns
+// the number of tunnels dropped.
+func (s *Store) Evict(before time.Time, active func(tunnel string) bool) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	evicted := 0
+	for tunnel, stats := range s.stats {
+		if stats.LastRequest.Before(before) && !active(tunnel) {
+			delete(s.rings, tunnel)
+			delete(s.stats, tunnel)
+			evicted++
+		}
+	}
+	return evicted
+}
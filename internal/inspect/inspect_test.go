@@ -0,0 +1,99 @@
+package inspect
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	if got := r.List(); len(got) != 0 {
+		t.Errorf("List() of empty ring got = %v", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		r.Add(Exchange{ID: strconv.Itoa(i)})
+	}
+	got := r.List()
+	if len(got) != 3 || got[0].ID != "4" || got[1].ID != "3" || got[2].ID != "2" {
+		t.Errorf("List() got = %v, want 4, 3, 2", got)
+	}
+	if _, ok := r.Get("1"); ok {
+		t.Errorf("Get() found evicted exchange")
+	}
+	if ex, ok := r.Get("3"); !ok || ex.ID != "3" {
+		t.Errorf("Get() got = %v, %v", ex, ok)
+	}
+}
+
+func TestBody(t *testing.T) {
+	var b Body
+	b.Write(bytes.Repeat([]byte("x"), BodyLimit-1))
+	b.Write([]byte("yz"))
+	got, truncated := b.Bytes()
+	if len(got) != BodyLimit || !truncated || got[len(got)-1] != 'y' {
+		t.Errorf("Bytes() got %d bytes, truncated = %v", len(got), truncated)
+	}
+	if b.Size() != BodyLimit+1 {
+		t.Errorf("Size() got = %d, want %d", b.Size(), BodyLimit+1)
+	}
+}
+
+func TestRing_Subscribe(t *testing.T) {
+	r := NewRing(3)
+	ch, unsubscribe := r.Subscribe()
+	r.Add(Exchange{ID: "1"})
+	if ex := <-ch; ex.ID != "1" {
+		t.Errorf("Subscribe() got = %v, want 1", ex.ID)
+	}
+
+	unsubscribe()
+	r.Add(Exchange{ID: "2"})
+	select {
+	case ex := <-ch:
+		t.Errorf("received %v after unsubscribing", ex.ID)
+	default:
+	}
+}
+
+func TestStore_Stats(t *testing.T) {
+	s := NewStore(2)
+	last := time.Now()
+	s.Add("tunnel", Exchange{ID: "1", Status: 200, Time: last.Add(-time.Second)})
+	s.Add("tunnel", Exchange{ID: "2", Status: 502, Time: last})
+	s.Add("tunnel", Exchange{ID: "3", Error: "response aborted", Time: last.Add(-time.Minute)})
+
+	got := s.Stats("tunnel")
+	if got.Requests != 3 || got.Errors != 2 || !got.LastRequest.Equal(last) {
+		t.Errorf("Stats() got = %+v", got)
+	}
+	if got := s.Stats("other"); got.Requests != 0 {
+		t.Errorf("Stats() of unknown tunnel got = %+v", got)
+	}
+}
+
+func TestStore_Evict(t *testing.T) {
+	s := NewStore(2)
+	now := time.Now()
+	s.Add("gone", Exchange{ID: "1", Time: now.Add(-2 * time.Hour)})
+	s.Add("connected", Exchange{ID: "2", Time: now.Add(-2 * time.Hour)})
+	s.Add("recent", Exchange{ID: "3", Time: now})
+
+	active := func(tunnel string) bool { return tunnel == "connected" }
+	if got := s.Evict(now.Add(-time.Hour), active); got != 1 {
+		t.Errorf("Evict() got = %d, want 1", got)
+	}
+	if got := s.List("gone"); len(got) != 0 {
+		t.Errorf("List() of evicted tunnel got = %v", got)
+	}
+	if got := s.Stats("gone"); got.Requests != 0 {
+		t.Errorf("Stats() of evicted tunnel got = %+v", got)
+	}
+	for _, tunnel := range []string{"connected", "recent"} {
+		if got := s.List(tunnel); len(got) != 1 {
+			t.Errorf("List(%s) got = %v, want it kept", tunnel, got)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill"
+	wmnats "github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/nats-io/nats.go"
+)
+
+// natsPubSub carries messages over core NATS subjects, one per topic.
+type natsPubSub struct {
+	*wmnats.Publisher
+	*wmnats.Subscriber
+}
+
+// NewNATS connects to the NATS server at url.
+func NewNATS(url string) (PubSub, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nats: %w", err)
+	}
+
+	// Publishing and subscribing share the connection, so a subscription
+	// reaches the server before anything published after it.
+	logger := watermill.NewStdLogger(false, false)
+	publisher, err := wmnats.NewPublisherWithNatsConn(conn, wmnats.PublisherPublishConfig{
+		Marshaler:         &wmnats.NATSMarshaler{},
+		SubjectCalculator: wmnats.DefaultSubjectCalculator,
+		JetStream:         wmnats.JetStreamConfig{Disabled: true},
+	}, logger)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	subscriber, err := wmnats.NewSubscriberWithNatsConn(conn, wmnats.SubscriberSubscriptionConfig{
+		JetStream: wmnats.JetStreamConfig{Disabled: true},
+	}, logger)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &natsPubSub{Publisher: publisher, Subscriber: subscriber}, nil
+}
+
+func (n *natsPubSub) Close() error {
+	return errors.Join(n.Subscriber.Close(), n.Publisher.Close())
+}
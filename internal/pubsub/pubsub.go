@@ -0,0 +1,68 @@
+// Package pubsub provides the message buses the server relays frames over.
+// The in-memory bus only reaches the clients of its own process, while the
+// redis and nats backends let several server instances behind a load
+// balancer forward requests to clients connected to any of them.
+package pubsub
+
+import (
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+)
+
+// Backends selectable in Config.
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+	BackendNATS   = "nats"
+)
+
+// PubSub publishes messages to topics and subscribes to them. Every topic
+// is read by a single subscriber, except for broadcasts that every server
+// instance subscribes to.
+type PubSub interface {
+	message.Publisher
+	message.Subscriber
+}
+
+// BroadcastPrefix starts the topics every server instance subscribes to,
+// such as admin commands. Subscribers of a broadcast only receive messages
+// published after they subscribed, where backends keeping messages would
+// otherwise replay its history to every instance starting up.
+const BroadcastPrefix = "reqbouncer."
+
+type Config struct {
+	// Backend is one of BackendMemory, BackendRedis or BackendNATS. When
+	// empty the in-memory backend is used.
+	Backend string
+	// URL locates the broker of the redis and nats backends, e.g.
+	// "redis://localhost:6379/0" or "nats://localhost:4222".
+	URL string
+}
+
+// New connects to the backend selected in cfg.
+func New(cfg Config) (PubSub, error) {
+	switch cfg.Backend {
+	case "", BackendMemory:
+		return NewMemory(), nil
+	case BackendRedis:
+		return NewRedis(cfg.URL)
+	case BackendNATS:
+		return NewNATS(cfg.URL)
+	default:
+		return nil, fmt.Errorf("unknown pubsub backend %q", cfg.Backend)
+	}
+}
+
+// NewMemory returns a bus local to the process.
+func NewMemory() PubSub {
+	return gochannel.NewGoChannel(
+		gochannel.Config{
+			// Streamed bodies are published chunk by chunk; blocking until the
+			// subscriber has written a chunk keeps them from piling up in memory.
+			BlockPublishUntilSubscriberAck: true,
+		},
+		watermill.NewStdLogger(false, false),
+	)
+}
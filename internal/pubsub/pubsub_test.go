@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/alicebob/miniredis/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var backends = []struct {
+	name string
+	cfg  func(t *testing.T) Config
+}{
+	{"memory", func(t *testing.T) Config {
+		return Config{}
+	}},
+	{"redis", func(t *testing.T) Config {
+		return Config{Backend: BackendRedis, URL: "redis://" + miniredis.RunT(t).Addr()}
+	}},
+	{"nats", func(t *testing.T) Config {
+		return Config{Backend: BackendNATS, URL: runNATS(t)}
+	}},
+}
+
+func TestBackends(t *testing.T) {
+	for _, tt := range backends {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := New(tt.cfg(t))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer ps.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msgs, err := ps.Subscribe(ctx, "topic")
+			if err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+
+			go func() {
+				for i := 0; i < 3; i++ {
+					msg := message.NewMessage(strconv.Itoa(i), []byte("payload "+strconv.Itoa(i)))
+					msg.Metadata.Set("seq", strconv.Itoa(i))
+					if err := ps.Publish("topic", msg); err != nil {
+						t.Errorf("Publish() error = %v", err)
+					}
+				}
+			}()
+
+			for i := 0; i < 3; i++ {
+				select {
+				case msg := <-msgs:
+					msg.Ack()
+					if msg.UUID != strconv.Itoa(i) || string(msg.Payload) != "payload "+strconv.Itoa(i) || msg.Metadata.Get("seq") != strconv.Itoa(i) {
+						t.Errorf("message %d got = %s %q %v", i, msg.UUID, msg.Payload, msg.Metadata)
+					}
+				case <-ctx.Done():
+					t.Fatalf("timed out waiting for message %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	for _, tt := range backends {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := New(tt.cfg(t))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer ps.Close()
+
+			topic := BroadcastPrefix + "test"
+			if err := ps.Publish(topic, message.NewMessage("old", nil)); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msgs, err := ps.Subscribe(ctx, topic)
+			if err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			go func() {
+				if err := ps.Publish(topic, message.NewMessage("new", nil)); err != nil {
+					t.Errorf("Publish() error = %v", err)
+				}
+			}()
+
+			select {
+			case msg := <-msgs:
+				msg.Ack()
+				if msg.UUID != "new" {
+					t.Errorf("first message got = %s, want the one published after subscribing", msg.UUID)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for message")
+			}
+		})
+	}
+}
+
+func runNATS(t *testing.T) string {
+	s, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server did not start")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisBlockTime bounds every XREAD, so a subscription whose topic never
+	// receives a message still notices its cancellation and returns its
+	// connection to the pool.
+	redisBlockTime = time.Second
+	// redisStreamTTL expires streams nobody writes to anymore, such as the
+	// topics of finished requests.
+	redisStreamTTL = 10 * time.Minute
+	// redisMaxLen caps every stream, bounding what a stalled subscriber can
+	// leave behind in Redis.
+	redisMaxLen = 10000
+)
+
+// redisPubSub carries messages over Redis Streams, one stream per topic.
+// Subscribers read a stream from its first entry, so messages published
+// between subscribing and the first read are not lost. Broadcasts are read
+// from their latest entry at the time of subscribing instead.
+//
+// It does not use watermill-redisstream, whose fan-out subscriber blocks on
+// its first read until a message arrives, holding a connection forever for
+// the topic of a request that is never answered.
+type redisPubSub struct {
+	client    *redis.Client
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRedis connects to the Redis server at url.
+func NewRedis(url string) (PubSub, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not connect to redis: %w", err)
+	}
+	return &redisPubSub{client: client, closing: make(chan struct{})}, nil
+}
+
+func (r *redisPubSub) Publish(topic string, msgs ...*message.Message) error {
+	ctx := context.Background()
+	for _, msg := range msgs {
+		metadata, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+			p.XAdd(ctx, &redis.XAddArgs{
+				Stream: topic,
+				MaxLen: redisMaxLen,
+				Approx: true,
+				Values: map[string]any{"uuid": msg.UUID, "metadata": metadata, "payload": []byte(msg.Payload)},
+			})
+			p.Expire(ctx, topic, redisStreamTTL)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+func (r *redisPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	lastID := "0"
+	if strings.HasPrefix(topic, BroadcastPrefix) {
+		latest, err := r.client.XRevRangeN(ctx, topic, "+", "-", 1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+		}
+		if len(latest) > 0 {
+			lastID = latest[0].ID
+		}
+	}
+
+	out := make(chan *message.Message)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.closing:
+				return
+			default:
+			}
+
+			streams, err := r.client.XRead(ctx, &redis.XReadArgs{Streams: []string{topic, lastID}, Block: redisBlockTime}).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("failed to read redis stream", slog.String("topic", topic), slog.Any("error", err))
+				select {
+				case <-time.After(redisBlockTime):
+					continue
+				case <-ctx.Done():
+					return
+				case <-r.closing:
+					return
+				}
+			}
+
+			for _, stream := range streams {
+				for _, entry := range stream.Messages {
+					lastID = entry.ID
+					msg, err := redisMessage(entry)
+					if err != nil {
+						slog.Error("dropping malformed redis message", slog.String("topic", topic), slog.Any("error", err))
+						continue
+					}
+					if !r.deliver(ctx, out, msg) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// deliver hands msg to the subscriber and waits for it to be acked,
+// delivering it again when it is nacked, like the in-memory backend does.
+func (r *redisPubSub) deliver(ctx context.Context, out chan<- *message.Message, msg *message.Message) bool {
+	for {
+		m := msg.Copy()
+		select {
+		case out <- m:
+		case <-ctx.Done():
+			return false
+		case <-r.closing:
+			return false
+		}
+		select {
+		case <-m.Acked():
+			return true
+		case <-m.Nacked():
+		case <-ctx.Done():
+			return false
+		case <-r.closing:
+			return false
+		}
+	}
+}
+
+func redisMessage(entry redis.XMessage) (*message.Message, error) {
+	uuid, _ := entry.Values["uuid"].(string)
+	payload, _ := entry.Values["payload"].(string)
+	msg := message.NewMessage(uuid, []byte(payload))
+	if metadata, ok := entry.Values["metadata"].(string); ok {
+		if err := json.Unmarshal([]byte(metadata), &msg.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (r *redisPubSub) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closing)
+		err = r.client.Close()
+	})
+	return err
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/authn"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminTopic is the broadcast admin commands are applied to every instance
+// through.
+const adminTopic = pubsub.BroadcastPrefix + "admin"
+
+// Actions of an adminCommand.
+const (
+	actionDisconnect = "disconnect"
+	actionBlock      = "block"
+	actionUnblock    = "unblock"
+	// actionRevokeSession ends a single session, actionRevokeSessions all
+	// sessions of a login.
+	actionRevokeSession  = "revoke_session"
+	actionRevokeSessions = "revoke_sessions"
+)
+
+// reasonDisconnected is sent to clients disconnected through the admin API.
+const reasonDisconnected = "disconnected by an administrator"
+
+type adminCommand struct {
+	Instance  string    `json:"instance"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Subdomain string    `json:"subdomain,omitempty"`
+	Login     string    `json:"login,omitempty"`
+	Session   string    `json:"session,omitempty"`
+}
+
+// blocklist holds the logins that may not open tunnels.
+type blocklist struct {
+	logins map[string]struct{}
+	mux    sync.Mutex
+}
+
+func newBlocklist(logins []string) *blocklist {
+	b := &blocklist{logins: make(map[string]struct{})}
+	for _, login := range logins {
+		b.Block(login)
+	}
+	return b
+}
+
+func (b *blocklist) Block(login string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.logins[strings.ToLower(login)] = struct{}{}
+}
+
+func (b *blocklist) Unblock(login string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.logins, strings.ToLower(login))
+}
+
+func (b *blocklist) Blocked(login string) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	_, ok := b.logins[strings.ToLower(login)]
+	return ok
+}
+
+// List returns the blocked logins in order.
+func (b *blocklist) List() []string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	logins := make([]string, 0, len(b.logins))
+	for login := range b.logins {
+		logins = append(logins, login)
+	}
+	slices.Sort(logins)
+	return logins
+}
+
+// admin serves the /_admin API. Disconnects and blocks are broadcast, so
+// they apply to the clients of every instance. Blocks made through the API
+// only last until the instances restart, permanent ones belong in the
+// blocked_logins setting.
+type admin struct {
+	cluster   *cluster
+	clientMap *clientMap
+	inspector *inspect.Store
+	blocked   *blocklist
+	sessions  *authn.Sessions
+	pubSub    pubsub.PubSub
+}
+
+// Run applies the commands broadcast by the other instances until ctx is
+// done.
+func (a *admin) Run(ctx context.Context) error {
+	msgs, err := a.pubSub.Subscribe(ctx, adminTopic)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range msgs {
+			msg.Ack()
+			var cmd adminCommand
+			if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+				slog.Error("failed to decode admin command", slog.Any("error", err))
+				continue
+			}
+			// Backends keeping history replay old commands to a new
+			// subscriber.
+			if cmd.Instance == a.cluster.instance || time.Since(cmd.Time) > instanceTTL {
+				continue
+			}
+			a.apply(cmd)
+		}
+	}()
+	return nil
+}
+
+// execute applies cmd on this instance and broadcasts it to the others.
+func (a *admin) execute(cmd adminCommand) error {
+	cmd.Instance = a.cluster.instance
+	cmd.Time = time.Now()
+	a.apply(cmd)
+
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return a.pubSub.Publish(adminTopic, message.NewMessage(watermill.NewUUID(), payload))
+}
+
+func (a *admin) apply(cmd adminCommand) {
+	slog.Info("applying admin command", slog.String("action", cmd.Action),
+		slog.String("subdomain", cmd.Subdomain), slog.String("login", cmd.Login), slog.String("session", cmd.Session))
+	switch cmd.Action {
+	case actionDisconnect:
+		a.clientMap.Disconnect(func(subdomain string) bool {
+			return subdomain == cmd.Subdomain
+		}, reasonDisconnected)
+	case actionBlock:
+		a.blocked.Block(cmd.Login)
+		a.clientMap.Disconnect(func(subdomain string) bool {
+			return wire.OwnsSubdomain(cmd.Login, subdomain)
+		}, "login blocked by an administrator")
+	case actionUnblock:
+		a.blocked.Unblock(cmd.Login)
+	case actionRevokeSession:
+		if err := a.sessions.Revoke(cmd.Session); err != nil {
+			slog.Error("failed to keep revoked session", slog.String("session", cmd.Session), slog.Any("error", err))
+		}
+	case actionRevokeSessions:
+		if err := a.sessions.RevokeLogin(cmd.Login, cmd.Time); err != nil {
+			slog.Error("failed to keep revoked sessions", slog.String("login", cmd.Login), slog.Any("error", err))
+		}
+		a.clientMap.Disconnect(func(subdomain string) bool {
+			return wire.OwnsSubdomain(cmd.Login, subdomain)
+		}, "sessions revoked by an administrator")
+	default:
+		slog.Warn("ignoring unknown admin command", slog.String("action", cmd.Action))
+	}
+}
+
+// tunnel is the admin view of a subdomain served by connected clients.
+type tunnel struct {
+	Subdomain   string        `json:"subdomain"`
+	Connections []connection  `json:"connections"`
+	Stats       inspect.Stats `json:"stats"`
+}
+
+// tunnels returns the connected tunnels in order. Their stats only cover
+// the requests that reached this instance.
+func (a *admin) tunnels() []tunnel {
+	var tunnels []tunnel
+	for _, conn := range a.cluster.Connections() {
+		if n := len(tunnels); n > 0 && tunnels[n-1].Subdomain == conn.Subdomain {
+			tunnels[n-1].Connections = append(tunnels[n-1].Connections, conn)
+			continue
+		}
+		tunnels = append(tunnels, tunnel{
+			Subdomain:   conn.Subdomain,
+			Connections: []connection{conn},
+			Stats:       a.inspector.Stats(conn.Subdomain),
+		})
+	}
+	return tunnels
+}
+
+func (a *admin) listTunnels(c echo.Context) error {
+	tunnels := a.tunnels()
+	if tunnels == nil {
+		tunnels = []tunnel{}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"tunnels": tunnels})
+}
+
+func (a *admin) getTunnel(c echo.Context) error {
+	for _, t := range a.tunnels() {
+		if t.Subdomain == c.Param("subdomain") {
+			return c.JSON(http.StatusOK, t)
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "no clients connected for this subdomain")
+}
+
+// disconnectTunnel closes every connection serving the subdomain. Clients
+// reconnect on their own unless their login is blocked as well.
+func (a *admin) disconnectTunnel(c echo.Context) error {
+	subdomain := c.Param("subdomain")
+	if !a.clientMap.HasClient(subdomain) {
+		return echo.NewHTTPError(http.StatusNotFound, "no clients connected for this subdomain")
+	}
+	if err := a.execute(adminCommand{Action: actionDisconnect, Subdomain: subdomain}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (a *admin) listBlocked(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{"logins": a.blocked.List()})
+}
+
+// blockLogin keeps login from opening tunnels and disconnects the ones it
+// has open.
+func (a *admin) blockLogin(c echo.Context) error {
+	if err := a.execute(adminCommand{Action: actionBlock, Login: c.Param("login")}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *admin) unblockLogin(c echo.Context) error {
+	if err := a.execute(adminCommand{Action: actionUnblock, Login: c.Param("login")}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeSessions logs login out of every session started so far and
+// disconnects its tunnels.
+func (a *admin) revokeSessions(c echo.Context) error {
+	if err := a.execute(adminCommand{Action: actionRevokeSessions, Login: c.Param("login")}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// newAdminMiddleware only lets the users listed in admins through, unless
+// their login is blocked, so a blocked administrator cannot unblock itself.
+func newAdminMiddleware(admins []string, authenticator authn.Authenticator, blocked *blocklist) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, err := bearerToken(c)
+			if err != nil {
+				return err
+			}
+			user, err := authenticate(c, authenticator, token)
+			if err != nil {
+				return err
+			}
+			if blocked.Blocked(user.Login) {
+				slog.Warn("rejected blocked user", slog.String("login", user.Login))
+				return echo.NewHTTPError(http.StatusForbidden, "login blocked by an administrator")
+			}
+			if !slices.ContainsFunc(admins, func(admin string) bool {
+				return strings.EqualFold(admin, user.Login)
+			}) {
+				slog.Warn("rejected admin request", slog.String("login", user.Login))
+				return echo.NewHTTPError(http.StatusForbidden, "user is not an administrator")
+			}
+			return next(c)
+		}
+	}
+}
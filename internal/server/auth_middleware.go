@@ -1,7 +1,9 @@
 package server
 
 import (
-	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"errors"
+	"github.com/znowdev/reqbouncer/internal/authn"
+	"github.com/znowdev/reqbouncer/internal/wire"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -9,44 +11,133 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func newAuthMiddleware(ciTestAccessToken string, githubProvider auth.GithubUserProvider) echo.MiddlewareFunc {
+func newAuthMiddleware(ciTestAccessToken string, authenticator authn.Authenticator, blocked *blocklist) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 
 			subDomain := c.Get("subdomain").(string)
 
-			authHeader := c.Request().Header.Get("Authorization")
-			if authHeader == "" {
-				return echo.NewHTTPError(http.StatusUnauthorized, "missing Authorization header")
+			// Any user may serve the host of a server reached through
+			// localhost, so it can be tried out without DNS.
+			authorize := authorizeSubdomain
+			if isLocalhost(subDomain) {
+				authorize = authenticateRequest
 			}
-
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				return echo.NewHTTPError(http.StatusUnauthorized, "malformed Authorization header")
+			user, err := authorize(c, subDomain, ciTestAccessToken, authenticator, blocked)
+			if err != nil {
+				return err
 			}
 
-			if subDomain == "ci-test" {
-				if parts[1] != ciTestAccessToken {
-					return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+			if name := c.Request().Header.Get(wire.TunnelNameHeader); name != "" {
+				if !wire.ValidTunnelName(name) {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid tunnel name")
 				}
-				return next(c)
+				c.Set("subdomain", wire.NamedSubdomain(name, user.Login))
 			}
 
-			githubUser, err := githubProvider(parts[1])
-			if err != nil {
-				slog.Error("error getting user from github", "error", err)
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
-			}
+			return next(c)
+		}
+	}
+}
 
-			if !isLocalhost(subDomain) && strings.ToLower(githubUser.Login) != strings.ToLower(subDomain) {
-				return echo.NewHTTPError(http.StatusUnauthorized, "user not allowed to access this subdomain")
+// newTunnelOwnerMiddleware only lets the owner of the tunnel named by the
+// subdomain path parameter through.
+func newTunnelOwnerMiddleware(ciTestAccessToken string, authenticator authn.Authenticator, blocked *blocklist) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, err := authorizeSubdomain(c, c.Param("subdomain"), ciTestAccessToken, authenticator, blocked); err != nil {
+				return err
 			}
-
 			return next(c)
 		}
 	}
 }
 
+// bearerToken returns the token of the Authorization header of c.
+func bearerToken(c echo.Context) (string, error) {
+	authHeader := c.Request().Header.Get("Authorization")
+	if authHeader == "" {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "missing Authorization header")
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "malformed Authorization header")
+	}
+	return parts[1], nil
+}
+
+// authorizeSubdomain resolves the user behind the bearer token of c and
+// checks that it owns subDomain.
+func authorizeSubdomain(c echo.Context, subDomain, ciTestAccessToken string, authenticator authn.Authenticator, blocked *blocklist) (authn.Identity, error) {
+	user, err := authenticateRequest(c, subDomain, ciTestAccessToken, authenticator, blocked)
+	if err != nil {
+		return authn.Identity{}, err
+	}
+	if !wire.OwnsSubdomain(user.Login, subDomain) {
+		return authn.Identity{}, echo.NewHTTPError(http.StatusUnauthorized, "user not allowed to access this subdomain")
+	}
+	return user, nil
+}
+
+// authenticateRequest resolves the user behind the bearer token of c, which
+// must be the CI test token for the ci-test subdomain.
+func authenticateRequest(c echo.Context, subDomain, ciTestAccessToken string, authenticator authn.Authenticator, blocked *blocklist) (authn.Identity, error) {
+	token, err := bearerToken(c)
+	if err != nil {
+		return authn.Identity{}, err
+	}
+
+	if subDomain == "ci-test" {
+		if token != ciTestAccessToken {
+			return authn.Identity{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		}
+		return authn.Identity{Login: subDomain}, nil
+	}
+
+	user, err := authenticate(c, authenticator, token)
+	if err != nil {
+		return authn.Identity{}, err
+	}
+
+	if blocked.Blocked(user.Login) {
+		slog.Warn("rejected blocked user", slog.String("login", user.Login))
+		return authn.Identity{}, echo.NewHTTPError(http.StatusForbidden, "login blocked by an administrator")
+	}
+	return user, nil
+}
+
+// authenticate resolves the user behind token. Rejected tokens and
+// unreachable providers both end in a 401, only the latter are logged as
+// errors. Users the provider denied access get a 403 telling them why, and
+// users whose session expired a 401 telling them to log in again. Logins
+// that are not a ValidLogin are denied.
+func authenticate(c echo.Context, authenticator authn.Authenticator, token string) (authn.Identity, error) {
+	user, err := authenticator.Authenticate(c.Request().Context(), token)
+	if err != nil {
+		if errors.Is(err, authn.ErrForbidden) {
+			slog.Warn("denied access", slog.Any("error", err))
+			return authn.Identity{}, echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		if errors.Is(err, authn.ErrSessionExpired) {
+			return authn.Identity{}, echo.NewHTTPError(http.StatusUnauthorized, "session expired, run reqbouncer login again")
+		}
+		if errors.Is(err, authn.ErrInvalidToken) {
+			slog.Warn("rejected token", slog.Any("error", err))
+		} else {
+			slog.Error("failed to authenticate", slog.Any("error", err))
+		}
+		return authn.Identity{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+	}
+	// The providers already check logins, a login with "--" slipping
+	// through would own the named tunnels of another user.
+	if !authn.ValidLogin(strings.ToLower(user.Login)) {
+		slog.Warn("denied access to invalid login", slog.String("login", user.Login))
+		return authn.Identity{}, echo.NewHTTPError(http.StatusForbidden, "invalid login")
+	}
+	return user, nil
+}
+
 func isLocalhost(host string) bool {
 	return strings.HasPrefix(host, "localhost:") || strings.HasPrefix(host, "127.0.0.1:")
 }
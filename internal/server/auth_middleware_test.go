@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/authn"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// githubStub authenticates the GitHub tokens "gho_<login>".
+type githubStub struct{}
+
+func (githubStub) Authenticate(_ context.Context, token string) (authn.Identity, error) {
+	login, ok := strings.CutPrefix(token, "gho_")
+	if !ok {
+		return authn.Identity{}, authn.ErrInvalidToken
+	}
+	return authn.Identity{Login: login, Provider: authn.ProviderGitHub}, nil
+}
+
+func authorize(t *testing.T, authenticator authn.Authenticator, subdomain, token string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/_websocket", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	_, err := authorizeSubdomain(c, subdomain, "", authenticator, newBlocklist(nil))
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	if err != nil {
+		t.Fatalf("authorizeSubdomain() error = %v", err)
+	}
+	return http.StatusOK
+}
+
+func TestAuthorizeSubdomain_NamedTunnels(t *testing.T) {
+	sessions, err := authn.NewSessions(authn.SessionConfig{Secret: strings.Repeat("s", 32), TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := sessions.Authenticator(githubStub{}, authn.ProviderGitHub)
+
+	if got := authorize(t, authenticator, "api--bob", "gho_bob"); got != http.StatusOK {
+		t.Errorf("bob opening api--bob got = %d, want 200", got)
+	}
+	for _, token := range []string{"gho_x--bob", "gho_api--bob"} {
+		if got := authorize(t, authenticator, "api--bob", token); got == http.StatusOK {
+			t.Errorf("%s opening api--bob got = %d, want it denied", token, got)
+		}
+	}
+
+	// A user of the static provider named bob, e.g. from before the server
+	// switched to GitHub, is not the GitHub user bob.
+	static, err := sessions.Issue(authn.Identity{Login: "bob", Provider: authn.ProviderStatic}, "bob-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authorize(t, authenticator, "api--bob", static.Token); got != http.StatusUnauthorized {
+		t.Errorf("static user bob opening api--bob got = %d, want 401", got)
+	}
+
+	// Static token files cannot name users after the tunnels of others.
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("api--bob secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authn.NewStatic(path); err == nil {
+		t.Errorf("NewStatic() with login api--bob succeeded")
+	}
+}
+
+func TestAuthorizeSubdomain_Localhost(t *testing.T) {
+	// Only the Host of a websocket may be claimed by anyone through
+	// localhost, the tunnels named in paths are checked for their owner.
+	if got := authorize(t, githubStub{}, "localhost:8080", "gho_bob"); got != http.StatusUnauthorized {
+		t.Errorf("bob authorizing localhost:8080 got = %d, want 401", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_websocket", nil)
+	req.Header.Set("Authorization", "Bearer gho_bob")
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.Set("subdomain", "localhost:8080")
+	mw := newAuthMiddleware("", githubStub{}, newBlocklist(nil))
+	if err := mw(func(echo.Context) error { return nil })(c); err != nil {
+		t.Errorf("bob connecting to localhost:8080 error = %v", err)
+	}
+}
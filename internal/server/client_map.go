@@ -1,44 +1,291 @@
 package server
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"github.com/lxzan/gws"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errClientConnected = errors.New("client already connected")
+	errPoolMismatch    = errors.New("subdomain is served by a pool with a different strategy")
+)
+
+// clientInfo describes what was negotiated with a connected client.
+type clientInfo struct {
+	Capabilities wire.Capabilities
+	Tunnel       string
+}
+
+// poolMember is a single client connection serving a subdomain. Requests for
+// it are published to Topic, which is unique to the connection.
+type poolMember struct {
+	Topic    string
+	Info     clientInfo
+	Presence presence
+	// Instance is the server instance the client is connected to, empty for
+	// clients of this one.
+	Instance string
+	inflight *inflightRequests
+	socket   *gws.Conn
+	// reported is the inflight count last announced by Instance.
+	reported int
+}
+
+// load returns the number of requests the member is working on.
+func (m *poolMember) load() int {
+	if m.inflight == nil {
+		return m.reported
+	}
+	return m.inflight.Len()
+}
+
+// clientPool holds the connections serving a subdomain. A pool without a
+// strategy is exclusive and never holds more than one member.
+type clientPool struct {
+	strategy string
+	members  []*poolMember
+	next     int
+}
+
+// pick returns the member the next request should go to.
+func (p *clientPool) pick() *poolMember {
+	start := p.next % len(p.members)
+	p.next++
+	if p.strategy != wire.PoolLeastInflight {
+		return p.members[start]
+	}
+
+	// Ties go to the member round-robin would have picked, so idle pools
+	// still spread the load.
+	best := p.members[start]
+	for i := 1; i < len(p.members); i++ {
+		m := p.members[(start+i)%len(p.members)]
+		if m.load() < best.load() {
+			best = m
+		}
+	}
+	return best
+}
 
 type clientMap struct {
-	clients map[string]struct{}
-	mux     sync.Mutex
+	pools map[string]*clientPool
+	mux   sync.Mutex
 }
 
-func (cm *clientMap) AddClient(clientId string) {
+// CanJoin reports whether a client asking for strategy may connect to
+// clientId, so it can be rejected before the websocket upgrade.
+func (cm *clientMap) CanJoin(clientId string, strategy string) error {
 	cm.mux.Lock()
 	defer cm.mux.Unlock()
-	cm.clients[clientId] = struct{}{}
+	return cm.canJoin(clientId, strategy)
+}
+
+func (cm *clientMap) canJoin(clientId string, strategy string) error {
+	// A client that went away without closing its socket must not keep its
+	// subdomain from being claimed again.
+	cm.expire(clientId)
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return nil
+	}
+	if pool.strategy == "" || strategy == "" {
+		holder := pool.members[0].Presence
+		return fmt.Errorf("%w from %s since %s", errClientConnected, holder.RemoteAddr, holder.ConnectedAt.Format(time.RFC3339))
+	}
+	if pool.strategy != strategy {
+		return errPoolMismatch
+	}
+	return nil
+}
+
+// AddClient registers member under clientId, creating the pool on its first
+// member.
+func (cm *clientMap) AddClient(clientId string, strategy string, member *poolMember) error {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	if err := cm.canJoin(clientId, strategy); err != nil {
+		return err
+	}
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		pool = &clientPool{strategy: strategy}
+		cm.pools[clientId] = pool
+	}
+	pool.members = append(pool.members, member)
+	return nil
+}
+
+// Client returns what was negotiated with the first client serving clientId.
+func (cm *clientMap) Client(clientId string) (clientInfo, bool) {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return clientInfo{}, false
+	}
+	return pool.members[0].Info, true
+}
+
+// Pick selects the connection the next request for clientId is sent to.
+func (cm *clientMap) Pick(clientId string) (*poolMember, bool) {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return nil, false
+	}
+	return pool.pick(), true
 }
 
 func (cm *clientMap) HasClient(clientId string) bool {
 	cm.mux.Lock()
 	defer cm.mux.Unlock()
-	_, ok := cm.clients[clientId]
+	_, ok := cm.pools[clientId]
 	return ok
 
 }
 
-func (cm *clientMap) RemoveClient(clientId string) {
+// RemoveClient removes the connection publishing on topic from clientId's
+// pool, dropping the pool once it is empty.
+func (cm *clientMap) RemoveClient(clientId string, topic string) {
 	cm.mux.Lock()
 	defer cm.mux.Unlock()
-	delete(cm.clients, clientId)
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return
+	}
+	for i, m := range pool.members {
+		if m.Topic == topic {
+			pool.members = append(pool.members[:i], pool.members[i+1:]...)
+			break
+		}
+	}
+	if len(pool.members) == 0 {
+		delete(cm.pools, clientId)
+	}
+}
+
+// Local returns the pools of the clients connected to this instance, as
+// announced to the other instances.
+func (cm *clientMap) Local() []announcedPool {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	var pools []announcedPool
+	for clientId, pool := range cm.pools {
+		ap := announcedPool{Subdomain: clientId, Strategy: pool.strategy}
+		for _, m := range pool.members {
+			if m.Instance == "" {
+				ap.Members = append(ap.Members, announcedMember{
+					Topic:         m.Topic,
+					Capabilities:  m.Info.Capabilities.String(),
+					Tunnel:        m.Info.Tunnel,
+					Inflight:      m.load(),
+					ConnectedAt:   m.Presence.ConnectedAt,
+					RemoteAddr:    m.Presence.RemoteAddr,
+					Version:       m.Presence.Version,
+					LastHeartbeat: m.Presence.LastHeartbeat,
+				})
+			}
+		}
+		if len(ap.Members) > 0 {
+			pools = append(pools, ap)
+		}
+	}
+	return pools
+}
+
+// SetRemote replaces the clients connected to instance with pools. Conflicts
+// with the clients of other instances are not checked, as each instance
+// checked its own before accepting them.
+func (cm *clientMap) SetRemote(instance string, pools []announcedPool) {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	for clientId, pool := range cm.pools {
+		pool.members = slices.DeleteFunc(pool.members, func(m *poolMember) bool {
+			return m.Instance == instance
+		})
+		if len(pool.members) == 0 {
+			delete(cm.pools, clientId)
+		}
+	}
+	for _, ap := range pools {
+		pool, ok := cm.pools[ap.Subdomain]
+		if !ok {
+			pool = &clientPool{strategy: ap.Strategy}
+			cm.pools[ap.Subdomain] = pool
+		}
+		for _, m := range ap.Members {
+			pool.members = append(pool.members, &poolMember{
+				Topic: m.Topic,
+				Info:  clientInfo{Capabilities: wire.ParseCapabilities(m.Capabilities), Tunnel: m.Tunnel},
+				Presence: presence{
+					ConnectedAt:   m.ConnectedAt,
+					RemoteAddr:    m.RemoteAddr,
+					Version:       m.Version,
+					LastHeartbeat: m.LastHeartbeat,
+				},
+				Instance: instance,
+				reported: m.Inflight,
+			})
+		}
+	}
+}
+
+// Disconnect closes the local connections serving the subdomains matched by
+// match, telling their clients why.
+func (cm *clientMap) Disconnect(match func(clientId string) bool, reason string) {
+	for _, socket := range cm.localSockets(match) {
+		socket.WriteClose(CloseNormalClosure, []byte(reason))
+		_ = socket.NetConn().Close()
+	}
+}
+
+// localSockets returns the sockets of the local connections serving the
+// subdomains matched by match.
+func (cm *clientMap) localSockets(match func(clientId string) bool) []*gws.Conn {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	var sockets []*gws.Conn
+	for clientId, pool := range cm.pools {
+		if !match(clientId) {
+			continue
+		}
+		for _, m := range pool.members {
+			if m.socket != nil {
+				sockets = append(sockets, m.socket)
+			}
+		}
+	}
+	return sockets
 }
 
 func (cm *clientMap) Clients() []string {
 	cm.mux.Lock()
 	defer cm.mux.Unlock()
-	clients := make([]string, 0, len(cm.clients))
-	for client := range cm.clients {
+	clients := make([]string, 0, len(cm.pools))
+	for client := range cm.pools {
 		clients = append(clients, client)
 	}
 	return clients
 }
 
+// ConnectedClientsNo returns the number of clients connected to this
+// instance.
 func (cm *clientMap) ConnectedClientsNo() int {
 	cm.mux.Lock()
 	defer cm.mux.Unlock()
-	return len(cm.clients)
+	var n int
+	for _, pool := range cm.pools {
+		for _, m := range pool.members {
+			if m.Instance == "" {
+				n++
+			}
+		}
+	}
+	return n
 }
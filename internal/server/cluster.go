@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// registryTopic is the broadcast every instance announces its clients on.
+	registryTopic = pubsub.BroadcastPrefix + "registry"
+	// announceInterval is how often an instance announces its clients when
+	// they did not change.
+	announceInterval = 5 * time.Second
+	// instanceTTL is how long the clients of an instance that stopped
+	// announcing are kept.
+	instanceTTL = 3 * announceInterval
+)
+
+// announcement lists the clients connected to a server instance.
+type announcement struct {
+	Instance string          `json:"instance"`
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Pools    []announcedPool `json:"pools"`
+}
+
+type announcedPool struct {
+	Subdomain string            `json:"subdomain"`
+	Strategy  string            `json:"strategy"`
+	Members   []announcedMember `json:"members"`
+}
+
+type announcedMember struct {
+	Topic         string    `json:"topic"`
+	Capabilities  string    `json:"capabilities"`
+	Tunnel        string    `json:"tunnel"`
+	Inflight      int       `json:"inflight"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Version       string    `json:"version"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+type peer struct {
+	seq      uint64
+	lastSeen time.Time
+}
+
+// cluster shares the clients connected to this instance with the other
+// server instances on the pubsub and keeps theirs in the clientMap, so a
+// request landing on any instance reaches its client.
+type cluster struct {
+	instance  string
+	clientMap *clientMap
+	pubSub    pubsub.PubSub
+	seq       uint64
+	peers     map[string]peer
+	mux       sync.Mutex
+}
+
+func newCluster(cm *clientMap, pubSub pubsub.PubSub) *cluster {
+	return &cluster{instance: uuid.NewString(), clientMap: cm, pubSub: pubSub, peers: make(map[string]peer)}
+}
+
+// Run follows the announcements of the other instances and announces the
+// clients of this one until ctx is done.
+func (c *cluster) Run(ctx context.Context) error {
+	msgs, err := c.pubSub.Subscribe(ctx, registryTopic)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range msgs {
+			msg.Ack()
+			c.receive(msg)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.expire()
+				c.clientMap.Expire()
+				c.Announce()
+			}
+		}
+	}()
+	c.Announce()
+	return nil
+}
+
+// Announce publishes the clients connected to this instance.
+func (c *cluster) Announce() {
+	c.mux.Lock()
+	c.seq++
+	a := announcement{Instance: c.instance, Seq: c.seq, Time: time.Now(), Pools: c.clientMap.Local()}
+	c.mux.Unlock()
+
+	payload, err := json.Marshal(a)
+	if err != nil {
+		slog.Error("failed to encode announcement", slog.Any("error", err))
+		return
+	}
+	if err := c.pubSub.Publish(registryTopic, message.NewMessage(watermill.NewUUID(), payload)); err != nil {
+		slog.Error("failed to announce clients", slog.Any("error", err))
+	}
+}
+
+func (c *cluster) receive(msg *message.Message) {
+	var a announcement
+	if err := json.Unmarshal(msg.Payload, &a); err != nil {
+		slog.Error("failed to decode announcement", slog.Any("error", err))
+		return
+	}
+	// Backends keeping history replay the announcements of instances long
+	// gone to a new subscriber.
+	if a.Instance == c.instance || time.Since(a.Time) > instanceTTL {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	p, known := c.peers[a.Instance]
+	if known && a.Seq <= p.seq {
+		return
+	}
+	if !known {
+		slog.Info("server instance joined", slog.String("instance", a.Instance))
+	}
+	c.peers[a.Instance] = peer{seq: a.Seq, lastSeen: time.Now()}
+	c.clientMap.SetRemote(a.Instance, a.Pools)
+}
+
+// Connections lists the clients connected to every instance of the cluster.
+func (c *cluster) Connections() []connection {
+	return c.clientMap.Connections(c.instance)
+}
+
+// expire drops the clients of instances that stopped announcing.
+func (c *cluster) expire() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for instance, p := range c.peers {
+		if time.Since(p.lastSeen) > instanceTTL {
+			slog.Warn("server instance expired", slog.String("instance", instance))
+			delete(c.peers, instance)
+			c.clientMap.SetRemote(instance, nil)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// redisCredentialsPrefix starts the keys holding the sealed provider token
+// of a session, expiring with the session.
+const redisCredentialsPrefix = "reqbouncer:credential:"
+
+// redisCredentials is the authn.CredentialStore of the instances using the
+// redis pubsub backend, so every instance can recheck the sessions issued by
+// the others.
+type redisCredentials struct {
+	client *redis.Client
+}
+
+func newRedisCredentials(url string) (*redisCredentials, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	return &redisCredentials{client: redis.NewClient(opts)}, nil
+}
+
+func (r *redisCredentials) StoreCredential(id, credential string, expires time.Time) error {
+	ctx := context.Background()
+	key := redisCredentialsPrefix + id
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, key, credential, 0)
+		p.PExpireAt(ctx, key, expires)
+		return nil
+	})
+	return err
+}
+
+func (r *redisCredentials) Credential(id string) (string, error) {
+	credential, err := r.client.Get(context.Background(), redisCredentialsPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return credential, err
+}
+
+func (r *redisCredentials) DeleteCredential(id string) error {
+	return r.client.Del(context.Background(), redisCredentialsPrefix+id).Err()
+}
+
+func (r *redisCredentials) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"testing"
+	"time"
+)
+
+func TestRedisCredentials(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r, err := newRedisCredentials("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.StoreCredential("session1", "sealed1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StoreCredential("session2", "sealed2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Credential("session1"); err != nil || got != "sealed1" {
+		t.Errorf("Credential() got = %q, %v, want sealed1", got, err)
+	}
+	if err := r.DeleteCredential("session1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.Credential("session1"); err != nil || got != "" {
+		t.Errorf("Credential() of deleted session got = %q, %v", got, err)
+	}
+
+	// Credentials expire with their sessions.
+	mr.FastForward(2 * time.Hour)
+	if got, err := r.Credential("session2"); err != nil || got != "" {
+		t.Errorf("Credential() of expired session got = %q, %v", got, err)
+	}
+}
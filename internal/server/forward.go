@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/tracing"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+)
+
+// Metadata keys used to carry wire frames through the pubsub.
+const (
+	metadataID    = "id"
+	metadataFrame = "frame"
+	metadataSeq   = "seq"
+	// metadataAbort marks a message telling the caller's handler that the
+	// response will never complete, with the reason as value.
+	metadataAbort = "abort"
+)
+
+// responseHeadTimeout bounds how long a caller waits for the target to start
+// responding. Once the head arrives the response may stream indefinitely.
+const responseHeadTimeout = 60 * time.Second
+
+func newFrameMessage(w wire.WireMessage) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), w.Payload)
+	msg.Metadata.Set(metadataID, w.ID)
+	msg.Metadata.Set(metadataFrame, strconv.Itoa(int(w.Type)))
+	msg.Metadata.Set(metadataSeq, strconv.FormatUint(uint64(w.Seq), 10))
+	return msg
+}
+
+func frameFromMessage(msg *message.Message) wire.WireMessage {
+	w := wire.WireMessage{
+		ID:      msg.Metadata.Get(metadataID),
+		Payload: msg.Payload,
+	}
+	if w.ID == "" {
+		w.ID = msg.UUID
+	}
+	if frame, err := strconv.Atoi(msg.Metadata.Get(metadataFrame)); err == nil {
+		w.Type = wire.FrameType(frame)
+	}
+	if seq, err := strconv.ParseUint(msg.Metadata.Get(metadataSeq), 10, 32); err == nil {
+		w.Seq = uint32(seq)
+	}
+	return w
+}
+
+// framePublisher publishes the frames of one stream direction to topic with
+// increasing seq numbers.
+type framePublisher struct {
+	pubSub pubsub.PubSub
+	topic  string
+	id     string
+	seq    uint32
+}
+
+func (p *framePublisher) Publish(frameType wire.FrameType, payload []byte) error {
+	msg := newFrameMessage(wire.WireMessage{ID: p.id, Type: frameType, Seq: p.seq, Payload: payload})
+	p.seq++
+	return p.pubSub.Publish(p.topic, msg)
+}
+
+// isForwardedRequest reports whether c is a public request that is tunneled
+// to a client. Those are relayed verbatim, so body limits and content
+// encoding middlewares must not touch them.
+func isForwardedRequest(c echo.Context) bool {
+	return c.Path() == "/*"
+}
+
+// fullDuplexMw lets forwarded requests keep reading the body of the caller
+// once the response started, which net/http otherwise discards: targets may
+// answer before the body was uploaded, e.g. echoing it. It runs before
+// slogecho wraps the writer without an Unwrap, and keeps the controller of
+// the connection for stopStreaming.
+func fullDuplexMw(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isForwardedRequest(c) {
+			rc := http.NewResponseController(c.Response().Writer)
+			if err := rc.EnableFullDuplex(); err != nil {
+				slog.Debug("failed to enable full duplex", slog.Any("error", err))
+			}
+			c.Set("responseController", rc)
+		}
+		return next(c)
+	}
+}
+
+// errClientLost is the abort reason published to the callers of a client
+// whose connection dropped.
+var errClientLost = errors.New("client disconnected")
+
+func (s *server) forwardRequest(c echo.Context) error {
+	subdomain := c.Get("subdomain").(string)
+
+	if isWebSocketUpgrade(c.Request()) {
+		return s.forwardWebSocket(c, subdomain, uuid.NewString())
+	}
+
+	return s.recordExchange(c, subdomain, func() error {
+		return traceRequest(c, subdomain, func() error {
+			return s.dispatchRequest(c, subdomain)
+		})
+	})
+}
+
+// dispatchRequest sends the request to a client serving subdomain and
+// relays its response.
+func (s *server) dispatchRequest(c echo.Context, subdomain string) error {
+	// A request that cannot have changed anything yet is replayed on
+	// another pool member when the client handling it drops.
+	replayable := isReplayable(c.Request())
+	for {
+		member, ok := s.clientMap.Pick(subdomain)
+		if !ok {
+			return abortResponse(c, errClientLost.Error())
+		}
+
+		err := s.exchange(c, subdomain, member, uuid.NewString())
+		if !errors.Is(err, errClientLost) {
+			return err
+		}
+		if !replayable || !s.clientMap.HasClient(subdomain) {
+			return abortResponse(c, err.Error())
+		}
+		slog.Info("client lost, retrying request on another pool member", slog.String("subdomain", subdomain))
+	}
+}
+
+// isReplayable reports whether req may be sent to the target again after
+// its first attempt was lost.
+func isReplayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+	}
+	return false
+}
+
+// exchange sends the request to member and relays its response to the
+// caller. It returns errClientLost if member dropped before the response
+// was committed.
+func (s *server) exchange(c echo.Context, subdomain string, member *poolMember, requestId string) (err error) {
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	// The tunnel span lasts until the response head is back. The client
+	// continues the trace from the traceparent of the forwarded request.
+	tunnelCtx, span := tracer.Start(ctx, "reqbouncer.tunnel", trace.WithAttributes(attribute.String("reqbouncer.request_id", requestId)))
+	defer func() {
+		tracing.End(span, 0, err)
+	}()
+	tracing.Inject(tunnelCtx, c.Request().Header)
+
+	// Subscribe before publishing so a fast response cannot be missed.
+	msgs, err := s.pubSub.Subscribe(ctx, requestId)
+	if err != nil {
+		return err
+	}
+
+	capabilities := member.Info.Capabilities
+	if capabilities.Has(wire.CapStreaming) {
+		streamed := make(chan struct{})
+		go func() {
+			defer close(streamed)
+			s.streamRequest(tunnelCtx, member.Topic, requestId, c.Request())
+		}()
+		defer stopStreaming(c, cancel, streamed)
+	} else if err := s.publishRequest(tunnelCtx, member.Topic, requestId, c.Request()); err != nil {
+		return err
+	}
+
+	// Unless the exchange runs to completion, tell the client to stop working
+	// on a request nobody is waiting for anymore.
+	var finished bool
+	defer func() {
+		if !finished && capabilities.Has(wire.CapCancel) {
+			s.cancelRequest(member.Topic, requestId)
+		}
+	}()
+
+	headTimer := time.NewTimer(responseHeadTimeout)
+	defer headTimer.Stop()
+	headTimeout := headTimer.C
+
+	var seq wire.Sequencer
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-headTimeout:
+			return echo.NewHTTPError(http.StatusGatewayTimeout, "timed out waiting for the client to respond")
+		case msg, ok := <-msgs:
+			if !ok {
+				return ctx.Err()
+			}
+			slog.Debug("received response", slog.Any("message_id", msg.UUID))
+			msg.Ack()
+
+			if reason := msg.Metadata.Get(metadataAbort); reason != "" {
+				finished = true
+				if reason == errClientLost.Error() && !c.Response().Committed {
+					return errClientLost
+				}
+				return abortResponse(c, reason)
+			}
+
+			frames, err := seq.Push(frameFromMessage(msg))
+			if err != nil {
+				return abortResponse(c, err.Error())
+			}
+			for _, frame := range frames {
+				if frame.Type == wire.FrameHead || frame.Type == wire.FrameHTTP {
+					headTimeout = nil
+					span.End()
+					_, span = tracer.Start(ctx, "reqbouncer.response")
+				}
+				if frame.Type == wire.FrameHTTP || frame.Type.IsFinal() {
+					finished = true
+				}
+				done, err := writeResponseFrame(c, frame)
+				if err != nil || done {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// stopStreaming stops streamRequest from uploading the body of the request
+// of c and waits for it to return. net/http does not allow reading the body
+// once the handler returned, which happens before the body was read when
+// the target answers without reading it or the exchange fails.
+func stopStreaming(c echo.Context, cancel context.CancelFunc, streamed <-chan struct{}) {
+	cancel()
+	select {
+	case <-streamed:
+		return
+	default:
+	}
+	// Unblock a read waiting for the caller to send more of the body.
+	rc, ok := c.Get("responseController").(*http.ResponseController)
+	if !ok {
+		rc = http.NewResponseController(c.Response())
+	}
+	if err := rc.SetReadDeadline(time.Now()); err != nil {
+		slog.Debug("failed to interrupt reading the request body", slog.Any("error", err))
+	}
+	_ = c.Request().Body.Close()
+	<-streamed
+}
+
+// cancelRequest asks the client subscribed to topic to abort the target
+// request for requestId.
+func (s *server) cancelRequest(topic, requestId string) {
+	slog.Debug("cancelling request", slog.String("request_id", requestId))
+	msg := newFrameMessage(wire.WireMessage{ID: requestId, Type: wire.FrameCancel})
+	if err := s.pubSub.Publish(topic, msg); err != nil {
+		slog.Error("failed to publish cancel", slog.Any("error", err), slog.String("request_id", requestId))
+	}
+}
+
+// abortResponse fails a response that will never complete. If the head was
+// already sent, the connection is torn down so the caller notices the
+// truncated body instead of seeing a clean end of stream.
+func abortResponse(c echo.Context, reason string) error {
+	slog.Warn("response aborted", slog.String("reason", reason))
+	if c.Response().Committed {
+		panic(http.ErrAbortHandler)
+	}
+	return echo.NewHTTPError(http.StatusBadGateway, reason)
+}
+
+// publishRequest sends the whole request as a single FrameHTTP to clients
+// that do not support streaming.
+func (s *server) publishRequest(ctx context.Context, topic, requestId string, req *http.Request) (err error) {
+	_, span := startPublishSpan(ctx, topic)
+	defer func() {
+		tracing.End(span, 0, err)
+	}()
+
+	buf := new(bytes.Buffer)
+	if err := req.Write(buf); err != nil {
+		return err
+	}
+
+	msg := newFrameMessage(wire.WireMessage{ID: requestId, Type: wire.FrameHTTP, Payload: buf.Bytes()})
+	slog.Debug("publishing message", slog.Any("message_id", msg.UUID))
+	return s.pubSub.Publish(topic, msg)
+}
+
+// startPublishSpan starts the span of publishing a request to topic.
+func startPublishSpan(ctx context.Context, topic string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "reqbouncer.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(semconv.MessagingDestinationName(topic)))
+}
+
+// streamRequest publishes the request head followed by its body in
+// wire.ChunkSize frames, so the body is never held in memory as a whole.
+func (s *server) streamRequest(ctx context.Context, topic, requestId string, req *http.Request) {
+	_, span := startPublishSpan(ctx, topic)
+	defer span.End()
+	publisher := &framePublisher{pubSub: s.pubSub, topic: topic, id: requestId}
+	publish := func(frameType wire.FrameType, payload []byte) error {
+		err := publisher.Publish(frameType, payload)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	}
+
+	head, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		slog.Error("failed to dump request head", slog.Any("error", err))
+		return
+	}
+	slog.Debug("publishing request head", slog.String("request_id", requestId))
+	if err := publish(wire.FrameHead, head); err != nil {
+		slog.Error("failed to publish request head", slog.Any("error", err))
+		return
+	}
+
+	buf := make([]byte, wire.ChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			_ = publish(wire.FrameEnd, []byte(err.Error()))
+			return
+		}
+		n, err := io.ReadFull(req.Body, buf)
+		if n > 0 {
+			if err := publish(wire.FrameBody, bytes.Clone(buf[:n])); err != nil {
+				slog.Error("failed to publish request body", slog.Any("error", err))
+				return
+			}
+		}
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			slog.Error("failed to read request body", slog.Any("error", err))
+			_ = publish(wire.FrameEnd, []byte(err.Error()))
+			return
+		}
+	}
+
+	if err := publish(wire.FrameEnd, nil); err != nil {
+		slog.Error("failed to publish request end", slog.Any("error", err))
+	}
+}
+
+// writeResponseFrame writes a frame received from the client to the public
+// caller and reports whether the response is complete.
+func writeResponseFrame(c echo.Context, frame wire.WireMessage) (bool, error) {
+	switch frame.Type {
+	case wire.FrameHTTP:
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(frame.Payload)), c.Request())
+		if err != nil {
+			return true, err
+		}
+		writeResponseHead(c, resp)
+		_, err = io.Copy(c.Response(), resp.Body)
+		return true, err
+	case wire.FrameHead:
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(frame.Payload)), c.Request())
+		if err != nil {
+			return true, err
+		}
+		writeResponseHead(c, resp)
+		c.Response().Flush()
+		return false, nil
+	case wire.FrameBody:
+		// Flush every chunk so event streams and long polls reach the
+		// caller as soon as the target produces them.
+		if _, err := c.Response().Write(frame.Payload); err != nil {
+			return true, err
+		}
+		c.Response().Flush()
+		return false, nil
+	case wire.FrameEnd:
+		if len(frame.Payload) > 0 {
+			return true, abortResponse(c, fmt.Sprintf("client aborted response: %s", frame.Payload))
+		}
+		return true, nil
+	default:
+		return true, fmt.Errorf("unexpected frame type %d", frame.Type)
+	}
+}
+
+// writeResponseHead replaces any headers set by middlewares with the ones
+// returned by the target, so the caller sees the target's response as is.
+func writeResponseHead(c echo.Context, resp *http.Response) {
+	header := c.Response().Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+}
@@ -0,0 +1,45 @@
+package server
+
+import "sync"
+
+// inflightRequests tracks the requests a socket has been sent but not yet
+// fully answered, so their callers can be released if the socket goes away.
+type inflightRequests struct {
+	ids map[string]struct{}
+	mux sync.Mutex
+}
+
+func newInflightRequests() *inflightRequests {
+	return &inflightRequests{ids: make(map[string]struct{})}
+}
+
+func (r *inflightRequests) Add(requestId string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ids[requestId] = struct{}{}
+}
+
+func (r *inflightRequests) Remove(requestId string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.ids, requestId)
+}
+
+// Drain removes and returns every tracked request.
+func (r *inflightRequests) Drain() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	ids := make([]string, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	clear(r.ids)
+	return ids
+}
+
+// Len returns the number of tracked requests.
+func (r *inflightRequests) Len() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return len(r.ids)
+}
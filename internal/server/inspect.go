@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// recordingWriter copies the response body written to the caller into the
+// exchange being recorded.
+type recordingWriter struct {
+	http.ResponseWriter
+	body *inspect.Body
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	_, _ = w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection of the caller.
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordExchange runs forward and records the request together with the
+// response it produced in the inspection history of subdomain.
+func (s *server) recordExchange(c echo.Context, subdomain string, forward func() error) (err error) {
+	req := c.Request()
+	ex := inspect.Exchange{
+		ID:            uuid.NewString(),
+		Time:          time.Now(),
+		Method:        req.Method,
+		Path:          req.RequestURI,
+		RequestHeader: req.Header.Clone(),
+	}
+
+	var reqBody, respBody inspect.Body
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(req.Body, &reqBody), req.Body}
+	c.Response().Writer = &recordingWriter{ResponseWriter: c.Response().Writer, body: &respBody}
+
+	defer func() {
+		ex.Latency = time.Since(ex.Time)
+		ex.RequestBody, ex.RequestTruncated = reqBody.Bytes()
+		ex.ResponseBody, ex.ResponseTruncated = respBody.Bytes()
+		if c.Response().Committed {
+			ex.Status = c.Response().Status
+			ex.ResponseHeader = c.Response().Header().Clone()
+		}
+
+		var httpErr *echo.HTTPError
+		switch r := recover(); {
+		case r != nil:
+			ex.Error = "response aborted"
+			s.inspector.Add(subdomain, ex)
+			s.metrics.Forwarded(subdomain, ex.Status, ex.Latency, reqBody.Size(), respBody.Size())
+			panic(r)
+		case errors.As(err, &httpErr):
+			ex.Status = httpErr.Code
+			ex.Error = fmt.Sprint(httpErr.Message)
+		case err != nil:
+			ex.Error = err.Error()
+		}
+		s.inspector.Add(subdomain, ex)
+		s.metrics.Forwarded(subdomain, ex.Status, ex.Latency, reqBody.Size(), respBody.Size())
+	}()
+
+	return forward()
+}
+
+// listRequests returns the recorded history of a tunnel, newest first.
+func (s *server) listRequests(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{"requests": s.inspector.List(c.Param("subdomain"))})
+}
+
+// evictInterval is how often the history and metrics of tunnels gone for
+// longer than inspect.DefaultRetention are dropped.
+const evictInterval = 5 * time.Minute
+
+// evictHistory drops the inspection history and the per-subdomain metrics of
+// tunnels without clients and requests for inspect.DefaultRetention until
+// ctx is done.
+func (s *server) evictHistory(ctx context.Context) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			before := time.Now().Add(-inspect.DefaultRetention)
+			if n := s.inspector.Evict(before, s.clientMap.HasClient); n > 0 {
+				slog.Debug("evicted inspection history", slog.Int("tunnels", n))
+			}
+			if n := s.metrics.Evict(before, s.clientMap.HasClient); n > 0 {
+				slog.Debug("evicted tunnel metrics", slog.Int("tunnels", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reconnectWindow is how soon after the last client of a subdomain
+// disconnected a new connection counts as a reconnect.
+const reconnectWindow = time.Minute
+
+// metrics are the Prometheus metrics of a server instance. Every instance
+// has its own registry, so several can run in one process.
+type metrics struct {
+	registry     *prometheus.Registry
+	requests     *prometheus.CounterVec
+	latency      prometheus.Histogram
+	bytes        *prometheus.CounterVec
+	authFailures *prometheus.CounterVec
+	connections  prometheus.Counter
+	reconnects   prometheus.Counter
+
+	// disconnects holds when the last client of a subdomain went away and
+	// forwarded when a request was last forwarded to one.
+	disconnects map[string]time.Time
+	forwarded   map[string]time.Time
+	mux         sync.Mutex
+}
+
+func newMetrics(cm *clientMap) *metrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m := &metrics{
+		registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reqbouncer_forwarded_requests_total",
+			Help: "Requests forwarded to clients, by subdomain and response status code, 0 when the caller got none.",
+		}, []string{"subdomain", "code"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "reqbouncer_tunnel_latency_seconds",
+			Help:    "Time from receiving a public request until its response was relayed.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reqbouncer_tunnel_bytes_total",
+			Help: "Body bytes relayed through tunnels, in for requests and out for responses.",
+		}, []string{"subdomain", "direction"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reqbouncer_auth_failures_total",
+			Help: "Rejected authentications, by response status code.",
+		}, []string{"code"}),
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reqbouncer_websocket_connections_total",
+			Help: "Client websocket connections accepted.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reqbouncer_websocket_reconnects_total",
+			Help: "Client websocket connections to a subdomain whose last client disconnected within a minute.",
+		}),
+		disconnects: make(map[string]time.Time),
+		forwarded:   make(map[string]time.Time),
+	}
+	registry.MustRegister(m.requests, m.latency, m.bytes, m.authFailures, m.connections, m.reconnects,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "reqbouncer_connected_clients",
+			Help: "Clients connected to this instance.",
+		}, func() float64 {
+			return float64(cm.ConnectedClientsNo())
+		}))
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format on the
+// public port, leaving compression to its gzip middleware.
+func (m *metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{DisableCompression: true})
+}
+
+// Serve exposes the metrics on /metrics of a dedicated listener until ctx is
+// done, so scrapers need no admin token and the path is not taken from the
+// tunnels served on the public port.
+func (m *metrics) Serve(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() { srv.Close() })
+	go srv.Serve(ln)
+	return nil
+}
+
+// Forwarded records a request forwarded to the client of subdomain.
+func (m *metrics) Forwarded(subdomain string, status int, latency time.Duration, in, out int64) {
+	m.requests.WithLabelValues(subdomain, strconv.Itoa(status)).Inc()
+	m.latency.Observe(latency.Seconds())
+	m.bytes.WithLabelValues(subdomain, "in").Add(float64(in))
+	m.bytes.WithLabelValues(subdomain, "out").Add(float64(out))
+	m.mux.Lock()
+	m.forwarded[subdomain] = time.Now()
+	m.mux.Unlock()
+}
+
+// Evict drops the series of the subdomains no request was forwarded to
+// since before, unless active reports them as still served, so subdomains
+// gone for good do not pile up in the registry.
+func (m *metrics) Evict(before time.Time, active func(subdomain string) bool) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	evicted := 0
+	for subdomain, at := range m.forwarded {
+		if at.Before(before) && !active(subdomain) {
+			m.requests.DeletePartialMatch(prometheus.Labels{"subdomain": subdomain})
+			m.bytes.DeletePartialMatch(prometheus.Labels{"subdomain": subdomain})
+			delete(m.forwarded, subdomain)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Connected records a client connecting to subdomain.
+func (m *metrics) Connected(subdomain string) {
+	m.connections.Inc()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if at, ok := m.disconnects[subdomain]; ok && time.Since(at) < reconnectWindow {
+		m.reconnects.Inc()
+	}
+	delete(m.disconnects, subdomain)
+}
+
+// Disconnected records the last client of subdomain going away.
+func (m *metrics) Disconnected(subdomain string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for s, at := range m.disconnects {
+		if time.Since(at) >= reconnectWindow {
+			delete(m.disconnects, s)
+		}
+	}
+	m.disconnects[subdomain] = time.Now()
+}
+
+// countAuthFailures counts the requests the authentication middlewares
+// after it reject.
+func (m *metrics) countAuthFailures(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) && (httpErr.Code == http.StatusUnauthorized || httpErr.Code == http.StatusForbidden) {
+			m.authFailures.WithLabelValues(strconv.Itoa(httpErr.Code)).Inc()
+		}
+		return err
+	}
+}
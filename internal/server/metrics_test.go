@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Evict(t *testing.T) {
+	m := newMetrics(&clientMap{pools: make(map[string]*clientPool)})
+	m.Forwarded("gone", http.StatusOK, time.Millisecond, 1, 2)
+	m.Forwarded("connected", http.StatusOK, time.Millisecond, 1, 2)
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	m.Forwarded("recent", http.StatusOK, time.Millisecond, 1, 2)
+
+	active := func(subdomain string) bool { return subdomain == "connected" }
+	if n := m.Evict(cutoff, active); n != 1 {
+		t.Errorf("Evict() got = %d, want 1", n)
+	}
+	if got := testutil.CollectAndCount(m.requests); got != 2 {
+		t.Errorf("requests series after Evict() got = %d, want 2", got)
+	}
+	if got := testutil.CollectAndCount(m.bytes); got != 4 {
+		t.Errorf("bytes series after Evict() got = %d, want 4", got)
+	}
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("recent", "200")); got != 1 {
+		t.Errorf("requests of recent subdomain got = %v, want 1", got)
+	}
+}
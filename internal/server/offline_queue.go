@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/lxzan/gws"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultOfflineQueueTTL is how long queued requests are kept, and how
+	// long a subdomain keeps queueing after its client disconnected.
+	defaultOfflineQueueTTL = time.Hour
+	// defaultOfflineQueueSize is the number of requests queued per subdomain.
+	defaultOfflineQueueSize = 100
+	// maxQueuedBody is the largest request body accepted into the queue.
+	maxQueuedBody = 1 << 20
+)
+
+var (
+	errQueueFull      = errors.New("offline queue is full")
+	errNotQueueing    = errors.New("subdomain does not queue requests")
+	errQueuedTooLarge = errors.New("request body too large to queue")
+)
+
+// offlineQueue keeps requests for subdomains whose client asked for them to
+// be accepted with a canned response while it is disconnected, and hands
+// them back in order once it reconnects.
+type offlineQueue interface {
+	// Connected records that a client connected to subdomain, asking for
+	// offline queueing with the canned status or not at all when status is
+	// 0. Requests queued before stay until they are popped.
+	Connected(subdomain string, status int) error
+	// Disconnected starts queueing for subdomain if its client opted in.
+	Disconnected(subdomain string) error
+	// Push queues msg for subdomain and returns the status to answer with.
+	Push(subdomain string, msg *message.Message) (int, error)
+	// Accepting reports whether requests for subdomain are queued.
+	Accepting(subdomain string) bool
+	// Pop removes the oldest request queued for subdomain that is still
+	// within its TTL. It returns nil once the queue is empty.
+	Pop(subdomain string) (*message.Message, error)
+	Close() error
+}
+
+// newOfflineQueue keeps the queue in the redis server at redisURL, where it
+// survives restarts and is shared by every instance, or in memory when
+// redisURL is empty.
+func newOfflineQueue(ttl time.Duration, size int, redisURL string) (offlineQueue, error) {
+	if ttl <= 0 {
+		ttl = defaultOfflineQueueTTL
+	}
+	if size <= 0 {
+		size = defaultOfflineQueueSize
+	}
+	if redisURL != "" {
+		return newRedisQueue(ttl, size, redisURL)
+	}
+	return newMemoryQueue(ttl, size), nil
+}
+
+// queuedRequest is a request accepted while no client was connected, kept
+// as the FrameHTTP message it will be delivered as.
+type queuedRequest struct {
+	msg      *message.Message
+	queuedAt time.Time
+}
+
+// subdomainQueue holds the requests of a subdomain whose client opted into
+// offline queueing.
+type subdomainQueue struct {
+	status         int
+	disconnectedAt time.Time
+	requests       []queuedRequest
+}
+
+// memoryQueue is the offlineQueue of a single instance. Its requests are
+// lost when the instance restarts.
+type memoryQueue struct {
+	ttl    time.Duration
+	size   int
+	queues map[string]*subdomainQueue
+	mux    sync.Mutex
+}
+
+func newMemoryQueue(ttl time.Duration, size int) *memoryQueue {
+	return &memoryQueue{ttl: ttl, size: size, queues: make(map[string]*subdomainQueue)}
+}
+
+func (q *memoryQueue) Connected(subdomain string, status int) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	sq, ok := q.queues[subdomain]
+	if !ok {
+		if status == 0 {
+			return nil
+		}
+		sq = &subdomainQueue{}
+		q.queues[subdomain] = sq
+	}
+	sq.status = status
+	sq.disconnectedAt = time.Time{}
+	return nil
+}
+
+func (q *memoryQueue) Disconnected(subdomain string) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if sq, ok := q.queues[subdomain]; ok && sq.status != 0 {
+		sq.disconnectedAt = time.Now()
+	}
+	return nil
+}
+
+// queue returns the queue accepting requests for subdomain, dropping it and
+// expired requests along the way.
+func (q *memoryQueue) queue(subdomain string) (*subdomainQueue, bool) {
+	sq, ok := q.queues[subdomain]
+	if !ok || sq.status == 0 || sq.disconnectedAt.IsZero() {
+		return nil, false
+	}
+	if time.Since(sq.disconnectedAt) >= q.ttl {
+		delete(q.queues, subdomain)
+		return nil, false
+	}
+	q.expire(sq)
+	return sq, true
+}
+
+// expire drops the requests of sq that outlived the TTL.
+func (q *memoryQueue) expire(sq *subdomainQueue) {
+	for len(sq.requests) > 0 && time.Since(sq.requests[0].queuedAt) >= q.ttl {
+		sq.requests = sq.requests[1:]
+	}
+}
+
+func (q *memoryQueue) Push(subdomain string, msg *message.Message) (int, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	sq, ok := q.queue(subdomain)
+	if !ok {
+		return 0, errNotQueueing
+	}
+	if len(sq.requests) >= q.size {
+		return 0, errQueueFull
+	}
+	sq.requests = append(sq.requests, queuedRequest{msg: msg, queuedAt: time.Now()})
+	return sq.status, nil
+}
+
+func (q *memoryQueue) Accepting(subdomain string) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	_, ok := q.queue(subdomain)
+	return ok
+}
+
+func (q *memoryQueue) Close() error {
+	return nil
+}
+
+func (q *memoryQueue) Pop(subdomain string) (*message.Message, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	sq, ok := q.queues[subdomain]
+	if !ok {
+		return nil, nil
+	}
+	q.expire(sq)
+	if len(sq.requests) == 0 {
+		if sq.status == 0 {
+			delete(q.queues, subdomain)
+		}
+		return nil, nil
+	}
+	msg := sq.requests[0].msg
+	sq.requests = sq.requests[1:]
+	return msg, nil
+}
+
+// queueRequest accepts the request of c into the offline queue of subdomain
+// and answers it with the canned status.
+func queueRequest(c echo.Context, q offlineQueue, subdomain string) error {
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxQueuedBody)
+	body, err := io.ReadAll(req.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errQueuedTooLarge.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read request body").SetInternal(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+
+	buf := new(bytes.Buffer)
+	if err := req.Write(buf); err != nil {
+		return err
+	}
+
+	requestId := uuid.NewString()
+	status, err := q.Push(subdomain, newFrameMessage(wire.WireMessage{ID: requestId, Type: wire.FrameHTTP, Payload: buf.Bytes()}))
+	if errors.Is(err, errQueueFull) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("queued request for offline client", slog.String("subdomain", subdomain), slog.String("request_id", requestId))
+	if status == http.StatusNoContent {
+		return c.NoContent(status)
+	}
+	return c.JSON(status, echo.Map{"status": "queued", "id": requestId})
+}
+
+// deliverQueued sends the requests queued for subdomain while its client was
+// offline over socket in the order they arrived, waiting for each response
+// before sending the next one. Responses are dropped, as their callers were
+// answered when the requests were queued. It reports whether socket is still
+// usable.
+func (c *Handler) deliverQueued(ctx context.Context, socket *gws.Conn, codec wire.Codec, subdomain string) bool {
+	var delivered int
+	defer func() {
+		if delivered > 0 {
+			slog.Info(fmt.Sprintf("delivered %d queued requests", delivered), slog.String("subdomain", subdomain))
+		}
+	}()
+
+	for {
+		msg, err := c.offline.Pop(subdomain)
+		if err != nil {
+			slog.Error("failed to read offline queue", slog.String("subdomain", subdomain), slog.Any("error", err))
+			return true
+		}
+		if msg == nil {
+			return true
+		}
+		if !c.deliverQueuedRequest(ctx, socket, codec, frameFromMessage(msg)) {
+			return false
+		}
+		delivered++
+	}
+}
+
+// deliverQueuedRequest writes frame to socket and waits for the client to
+// answer it, for at most responseHeadTimeout.
+func (c *Handler) deliverQueuedRequest(ctx context.Context, socket *gws.Conn, codec wire.Codec, frame wire.WireMessage) bool {
+	waitCtx, cancel := context.WithTimeout(ctx, responseHeadTimeout)
+	defer cancel()
+	responses, err := c.pubSub.Subscribe(waitCtx, frame.ID)
+	if err != nil {
+		slog.Error("failed to subscribe to queued request", slog.String("request_id", frame.ID), slog.Any("error", err))
+		return true
+	}
+
+	payload, err := codec.Encode(frame)
+	if err != nil {
+		slog.Error("failed to serialize message", slog.Any("error", err))
+		return true
+	}
+	inflight, _ := socket.Session().Load("inflight")
+	inflight.(*inflightRequests).Add(frame.ID)
+	if err := socket.WriteMessage(gws.OpcodeBinary, payload); err != nil {
+		slog.Error("failed to write queued request", slog.String("request_id", frame.ID), slog.Any("error", err))
+		return false
+	}
+
+	for {
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return false
+			}
+			slog.Warn("timed out waiting for the client to answer a queued request", slog.String("request_id", frame.ID))
+			inflight.(*inflightRequests).Remove(frame.ID)
+			return true
+		case msg, ok := <-responses:
+			if !ok {
+				return ctx.Err() == nil
+			}
+			msg.Ack()
+			if msg.Metadata.Get(metadataAbort) != "" {
+				return false
+			}
+			if resp := frameFromMessage(msg); resp.Type == wire.FrameHTTP || resp.Type.IsFinal() {
+				return true
+			}
+		}
+	}
+}
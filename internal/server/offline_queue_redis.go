@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisQueuePrefix starts the keys of the offline queue. Every subdomain has
+// a hash with the status its client asked for and when it disconnected, and
+// a list of its requests prefixed with the unix milliseconds they were
+// queued at.
+const redisQueuePrefix = "reqbouncer:offline:"
+
+// pushScript appends ARGV[4] to the requests of a queueing subdomain after
+// dropping the expired ones. It returns the status to answer with, 0 when
+// the subdomain is not queueing and -1 when its queue is full.
+var pushScript = redis.NewScript(`
+local status = tonumber(redis.call('HGET', KEYS[1], 'status') or '0')
+local since = tonumber(redis.call('HGET', KEYS[1], 'disconnected_at') or '0')
+local now, ttl, size = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+if status == 0 or since == 0 or now - since >= ttl then
+	return 0
+end
+while true do
+	local head = redis.call('LINDEX', KEYS[2], 0)
+	if not head then
+		break
+	end
+	local at = tonumber(string.match(head, '^(%d+) '))
+	if at and now - at < ttl then
+		break
+	end
+	redis.call('LPOP', KEYS[2])
+end
+if redis.call('LLEN', KEYS[2]) >= size then
+	return -1
+end
+redis.call('RPUSH', KEYS[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ttl)
+return status
+`)
+
+// disconnectScript records when the client of a queueing subdomain
+// disconnected and expires its state once it stops queueing.
+var disconnectScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], 'status') == 1 then
+	redis.call('HSET', KEYS[1], 'disconnected_at', ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisQueue is the offlineQueue shared by the instances using the redis
+// pubsub backend. Requests survive restarts and are delivered by whichever
+// instance the client reconnects to.
+type redisQueue struct {
+	client *redis.Client
+	ttl    time.Duration
+	size   int
+}
+
+func newRedisQueue(ttl time.Duration, size int, url string) (*redisQueue, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	return &redisQueue{client: redis.NewClient(opts), ttl: ttl, size: size}, nil
+}
+
+func (q *redisQueue) keys(subdomain string) (state, requests string) {
+	return redisQueuePrefix + subdomain, redisQueuePrefix + subdomain + ":requests"
+}
+
+func (q *redisQueue) Connected(subdomain string, status int) error {
+	ctx := context.Background()
+	state, _ := q.keys(subdomain)
+	_, err := q.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if status == 0 {
+			p.Del(ctx, state)
+			return nil
+		}
+		p.HSet(ctx, state, "status", status, "disconnected_at", 0)
+		p.Persist(ctx, state)
+		return nil
+	})
+	return err
+}
+
+func (q *redisQueue) Disconnected(subdomain string) error {
+	ctx := context.Background()
+	state, _ := q.keys(subdomain)
+	return disconnectScript.Run(ctx, q.client, []string{state}, time.Now().UnixMilli(), q.ttl.Milliseconds()).Err()
+}
+
+func (q *redisQueue) Push(subdomain string, msg *message.Message) (int, error) {
+	entry, err := json.Marshal(queuedMessage{UUID: msg.UUID, Metadata: msg.Metadata, Payload: msg.Payload})
+	if err != nil {
+		return 0, err
+	}
+	state, requests := q.keys(subdomain)
+	now := time.Now().UnixMilli()
+	status, err := pushScript.Run(context.Background(), q.client, []string{state, requests},
+		now, q.ttl.Milliseconds(), q.size, strconv.FormatInt(now, 10)+" "+string(entry)).Int()
+	if err != nil {
+		return 0, err
+	}
+	switch status {
+	case 0:
+		return 0, errNotQueueing
+	case -1:
+		return 0, errQueueFull
+	}
+	return status, nil
+}
+
+func (q *redisQueue) Accepting(subdomain string) bool {
+	state, _ := q.keys(subdomain)
+	values, err := q.client.HMGet(context.Background(), state, "status", "disconnected_at").Result()
+	if err != nil {
+		slog.Error("failed to read offline queue", slog.String("subdomain", subdomain), slog.Any("error", err))
+		return false
+	}
+	status, _ := values[0].(string)
+	since, _ := values[1].(string)
+	disconnectedAt, _ := strconv.ParseInt(since, 10, 64)
+	return status != "" && status != "0" && disconnectedAt != 0 &&
+		time.Since(time.UnixMilli(disconnectedAt)) < q.ttl
+}
+
+func (q *redisQueue) Pop(subdomain string) (*message.Message, error) {
+	_, requests := q.keys(subdomain)
+	for {
+		entry, err := q.client.LPop(context.Background(), requests).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		at, data, _ := strings.Cut(entry, " ")
+		queuedAt, _ := strconv.ParseInt(at, 10, 64)
+		if time.Since(time.UnixMilli(queuedAt)) >= q.ttl {
+			continue
+		}
+		var m queuedMessage
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			slog.Error("dropping malformed queued request", slog.String("subdomain", subdomain), slog.Any("error", err))
+			continue
+		}
+		msg := message.NewMessage(m.UUID, m.Payload)
+		msg.Metadata = m.Metadata
+		return msg, nil
+	}
+}
+
+func (q *redisQueue) Close() error {
+	return q.client.Close()
+}
+
+// queuedMessage is how a queued message is stored in redis.
+type queuedMessage struct {
+	UUID     string           `json:"uuid"`
+	Metadata message.Metadata `json:"metadata"`
+	Payload  []byte           `json:"payload"`
+}
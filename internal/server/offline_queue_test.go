@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	tests := []struct {
+		name string
+		url  func(t *testing.T) string
+	}{
+		{"memory", func(t *testing.T) string { return "" }},
+		{"redis", func(t *testing.T) string { return "redis://" + miniredis.RunT(t).Addr() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url(t)
+			q, err := newOfflineQueue(time.Hour, 2, url)
+			if err != nil {
+				t.Fatalf("newOfflineQueue() error = %v", err)
+			}
+			defer q.Close()
+
+			if _, err := q.Push("client1", message.NewMessage("first", nil)); !errors.Is(err, errNotQueueing) {
+				t.Errorf("Push() before opting in error = %v, want errNotQueueing", err)
+			}
+			if err := q.Connected("client1", http.StatusAccepted); err != nil {
+				t.Fatal(err)
+			}
+			if q.Accepting("client1") {
+				t.Errorf("Accepting() while connected = true")
+			}
+			if err := q.Disconnected("client1"); err != nil {
+				t.Fatal(err)
+			}
+			if !q.Accepting("client1") {
+				t.Errorf("Accepting() after disconnect = false")
+			}
+
+			for _, id := range []string{"first", "second"} {
+				if status, err := q.Push("client1", message.NewMessage(id, []byte(id))); err != nil || status != http.StatusAccepted {
+					t.Errorf("Push(%s) got = %d, %v, want 202", id, status, err)
+				}
+			}
+			if _, err := q.Push("client1", message.NewMessage("third", nil)); !errors.Is(err, errQueueFull) {
+				t.Errorf("Push() to full queue error = %v, want errQueueFull", err)
+			}
+
+			// Queues kept in redis outlive the instance that filled them.
+			if url != "" {
+				if q, err = newOfflineQueue(time.Hour, 2, url); err != nil {
+					t.Fatal(err)
+				}
+				defer q.Close()
+			}
+
+			// Reconnecting without opting in still delivers what was queued.
+			if err := q.Connected("client1", 0); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{"first", "second"} {
+				msg, err := q.Pop("client1")
+				if err != nil || msg == nil || msg.UUID != want || string(msg.Payload) != want {
+					t.Fatalf("Pop() got = %v, %v, want %s", msg, err, want)
+				}
+			}
+			if msg, err := q.Pop("client1"); err != nil || msg != nil {
+				t.Errorf("Pop() of empty queue got = %v, %v", msg, err)
+			}
+			if err := q.Disconnected("client1"); err != nil {
+				t.Fatal(err)
+			}
+			if q.Accepting("client1") {
+				t.Errorf("Accepting() after opting out = true")
+			}
+		})
+	}
+}
+
+func TestQueueRequest_BodyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{"too large", bytes.NewReader(make([]byte, maxQueuedBody+1)), http.StatusRequestEntityTooLarge},
+		{"read error", iotest.ErrReader(io.ErrUnexpectedEOF), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newOfflineQueue(time.Hour, 2, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+			if err := q.Connected("client1", http.StatusAccepted); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Disconnected("client1"); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/hook", tt.body)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			var httpErr *echo.HTTPError
+			if err := queueRequest(c, q, "client1"); !errors.As(err, &httpErr) || httpErr.Code != tt.want {
+				t.Errorf("queueRequest() error = %v, want status %d", err, tt.want)
+			}
+			if msg, _ := q.Pop("client1"); msg != nil {
+				t.Errorf("queueRequest() queued the failed request")
+			}
+		})
+	}
+}
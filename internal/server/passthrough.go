@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// isWebSocketUpgrade reports whether req asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardWebSocket hijacks the caller's connection and relays it to the
+// client as a raw stream. The client replays the upgrade request against the
+// target, so the handshake and every WebSocket frame pass through untouched.
+func (s *server) forwardWebSocket(c echo.Context, subdomain, streamId string) error {
+	member, ok := s.clientMap.Pick(subdomain)
+	if !ok {
+		return abortResponse(c, errClientLost.Error())
+	}
+	if !member.Info.Capabilities.Has(wire.CapWebSocket) {
+		return echo.NewHTTPError(http.StatusNotImplemented, "the connected client does not support websocket forwarding, please upgrade reqbouncer")
+	}
+
+	head, err := httputil.DumpRequest(c.Request(), false)
+	if err != nil {
+		return err
+	}
+
+	conn, bufrw, err := c.Response().Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	slog.Debug("relaying websocket", slog.String("stream_id", streamId))
+	return relayStream(s.pubSub, member.Topic, streamId, head, conn, bufrw.Reader)
+}
+
+// relayStream pipes conn through the tunnel as a raw stream started with a
+// FrameOpen carrying open, published on the client's topic. Bytes are read
+// from r, which may buffer data already read from conn. It returns once the
+// client closes the stream; the caller closing conn then closes the other
+// direction.
+func relayStream(pubSub pubsub.PubSub, topic, streamId string, open []byte, conn net.Conn, r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgs, err := pubSub.Subscribe(ctx, streamId)
+	if err != nil {
+		return err
+	}
+
+	publisher := &framePublisher{pubSub: pubSub, topic: topic, id: streamId}
+	if err := publisher.Publish(wire.FrameOpen, open); err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, wire.ChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if err := publisher.Publish(wire.FrameData, bytes.Clone(buf[:n])); err != nil {
+					slog.Error("failed to publish stream data", slog.Any("error", err))
+					return
+				}
+			}
+			if err != nil {
+				var reason []byte
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					reason = []byte(err.Error())
+				}
+				if err := publisher.Publish(wire.FrameClose, reason); err != nil {
+					slog.Error("failed to publish stream close", slog.Any("error", err))
+				}
+				return
+			}
+		}
+	}()
+
+	var seq wire.Sequencer
+	for msg := range msgs {
+		msg.Ack()
+		if reason := msg.Metadata.Get(metadataAbort); reason != "" {
+			slog.Warn("stream aborted", slog.String("reason", reason), slog.String("stream_id", streamId))
+			return nil
+		}
+
+		frames, err := seq.Push(frameFromMessage(msg))
+		if err != nil {
+			return err
+		}
+		for _, frame := range frames {
+			switch frame.Type {
+			case wire.FrameData:
+				if _, err := conn.Write(frame.Payload); err != nil {
+					return err
+				}
+			case wire.FrameClose:
+				slog.Debug("stream closed by client", slog.String("stream_id", streamId))
+				return nil
+			}
+		}
+	}
+	return nil
+}
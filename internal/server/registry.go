@@ -0,0 +1,133 @@
+package server
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// heartbeatTTL is how long a client connection counts as alive after its
+// last heartbeat. Clients ping every PingInterval, so one that stayed silent
+// for longer is gone even if its socket was never closed.
+const heartbeatTTL = PingInterval + PingWait
+
+// presence records where a client connected from and when it was last
+// heard of.
+type presence struct {
+	ConnectedAt   time.Time
+	RemoteAddr    string
+	Version       string
+	LastHeartbeat time.Time
+}
+
+func newPresence(remoteAddr, version string) presence {
+	now := time.Now()
+	return presence{ConnectedAt: now, RemoteAddr: remoteAddr, Version: version, LastHeartbeat: now}
+}
+
+// alive reports whether the member heartbeated recently enough. The
+// heartbeats of remote members are only learnt from announcements, so they
+// get an announcement interval of slack.
+func (m *poolMember) alive() bool {
+	ttl := heartbeatTTL
+	if m.Instance != "" {
+		ttl += announceInterval
+	}
+	return time.Since(m.Presence.LastHeartbeat) < ttl
+}
+
+// connection describes a client connected to an instance of the cluster.
+type connection struct {
+	Subdomain     string    `json:"subdomain"`
+	Instance      string    `json:"instance"`
+	Tunnel        string    `json:"tunnel"`
+	Pool          string    `json:"pool,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Version       string    `json:"version,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Inflight      int       `json:"inflight"`
+}
+
+// Heartbeat records that the connection publishing on topic is alive.
+func (cm *clientMap) Heartbeat(clientId string, topic string) {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return
+	}
+	for _, m := range pool.members {
+		if m.Topic == topic {
+			m.Presence.LastHeartbeat = time.Now()
+			return
+		}
+	}
+}
+
+// Expire drops the connections that stopped heartbeating.
+func (cm *clientMap) Expire() {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	for clientId := range cm.pools {
+		cm.expire(clientId)
+	}
+}
+
+// expire drops the dead members of clientId's pool. The sockets of local
+// ones are closed, so their OnClose releases what they were working on.
+func (cm *clientMap) expire(clientId string) {
+	pool, ok := cm.pools[clientId]
+	if !ok {
+		return
+	}
+	pool.members = slices.DeleteFunc(pool.members, func(m *poolMember) bool {
+		if m.alive() {
+			return false
+		}
+		slog.Warn("client stopped heartbeating", slog.String("subdomain", clientId),
+			slog.String("instance", m.Instance), slog.Time("last_heartbeat", m.Presence.LastHeartbeat))
+		if m.socket != nil {
+			_ = m.socket.NetConn().Close()
+		}
+		return true
+	})
+	if len(pool.members) == 0 {
+		delete(cm.pools, clientId)
+	}
+}
+
+// Connections lists the live connections of every instance, with those of
+// this one reported under instance.
+func (cm *clientMap) Connections(instance string) []connection {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	var conns []connection
+	for clientId, pool := range cm.pools {
+		for _, m := range pool.members {
+			if !m.alive() {
+				continue
+			}
+			conn := connection{
+				Subdomain:     clientId,
+				Instance:      m.Instance,
+				Tunnel:        m.Info.Tunnel,
+				Pool:          pool.strategy,
+				RemoteAddr:    m.Presence.RemoteAddr,
+				Version:       m.Presence.Version,
+				ConnectedAt:   m.Presence.ConnectedAt,
+				LastHeartbeat: m.Presence.LastHeartbeat,
+				Inflight:      m.load(),
+			}
+			if conn.Instance == "" {
+				conn.Instance = instance
+			}
+			conns = append(conns, conn)
+		}
+	}
+	slices.SortFunc(conns, func(a, b connection) int {
+		return cmp.Or(cmp.Compare(a.Subdomain, b.Subdomain), a.ConnectedAt.Compare(b.ConnectedAt))
+	})
+	return conns
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"log/slog"
+	"sync"
+)
+
+// relayQueueSize is the number of frames of a request queued for publishing
+// before the socket they arrive on stops reading.
+const relayQueueSize = wire.ReorderWindow
+
+// frameRelay publishes the frames read from a socket to the topics of their
+// requests. The frames of a request are published in the order they were
+// read by a goroutine of its own, so a request whose caller reads slowly
+// holds up neither the socket nor the other requests until its queue is
+// full.
+type frameRelay struct {
+	pubSub pubsub.PubSub
+	queues map[string]chan wire.WireMessage
+	mux    sync.Mutex
+}
+
+func newFrameRelay(pubSub pubsub.PubSub) *frameRelay {
+	return &frameRelay{pubSub: pubSub, queues: make(map[string]chan wire.WireMessage)}
+}
+
+// Relay queues w for publishing, blocking while the queue of its request is
+// full. It is only called from the read loop of the socket.
+func (r *frameRelay) Relay(w wire.WireMessage) {
+	final := w.Type == wire.FrameHTTP || w.Type.IsFinal()
+	r.mux.Lock()
+	queue, ok := r.queues[w.ID]
+	if !ok {
+		queue = make(chan wire.WireMessage, relayQueueSize)
+		r.queues[w.ID] = queue
+		go r.publish(queue)
+	}
+	if final {
+		delete(r.queues, w.ID)
+	}
+	r.mux.Unlock()
+
+	queue <- w
+	if final {
+		close(queue)
+	}
+}
+
+func (r *frameRelay) publish(queue <-chan wire.WireMessage) {
+	for w := range queue {
+		msg := newFrameMessage(w)
+		slog.Debug("publishing message", slog.Any("message_id", msg.UUID), slog.String("request_id", w.ID))
+		if err := r.pubSub.Publish(w.ID, msg); err != nil {
+			slog.Error("failed to publish message", slog.Any("error", err))
+		}
+	}
+}
+
+// Close stops publishing once the frames queued so far are published.
+func (r *frameRelay) Close() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for id, queue := range r.queues {
+		close(queue)
+		delete(r.queues, id)
+	}
+}
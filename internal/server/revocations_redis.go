@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisRevocationsPrefix starts the keys of revoked sessions. Every revoked
+// session has a key holding the unix milliseconds it expires at, every login
+// whose sessions were revoked one holding when they were, both expiring
+// once the sessions they revoke would have.
+const redisRevocationsPrefix = "reqbouncer:revoked:"
+
+// redisRevocations is the authn.RevocationStore of the instances using the
+// redis pubsub backend, so revocations survive restarts.
+type redisRevocations struct {
+	client *redis.Client
+}
+
+func newRedisRevocations(url string) (*redisRevocations, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	return &redisRevocations{client: redis.NewClient(opts)}, nil
+}
+
+func (r *redisRevocations) RevokeSession(id string, expires time.Time) error {
+	return r.set(redisRevocationsPrefix+"session:"+id, expires, expires)
+}
+
+func (r *redisRevocations) RevokeLogin(login string, before, expires time.Time) error {
+	return r.set(redisRevocationsPrefix+"login:"+login, before, expires)
+}
+
+func (r *redisRevocations) set(key string, at, expires time.Time) error {
+	ctx := context.Background()
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, key, at.UnixMilli(), 0)
+		p.PExpireAt(ctx, key, expires)
+		return nil
+	})
+	return err
+}
+
+func (r *redisRevocations) Revocations() (sessions, logins map[string]time.Time, err error) {
+	ctx := context.Background()
+	sessions = make(map[string]time.Time)
+	logins = make(map[string]time.Time)
+	iter := r.client.Scan(ctx, 0, redisRevocationsPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		value, err := r.client.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			// Expired since it was scanned.
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed revocation %s: %w", key, err)
+		}
+		kind, name, _ := strings.Cut(strings.TrimPrefix(key, redisRevocationsPrefix), ":")
+		switch kind {
+		case "session":
+			sessions[name] = time.UnixMilli(ms)
+		case "login":
+			logins[name] = time.UnixMilli(ms)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	return sessions, logins, nil
+}
+
+func (r *redisRevocations) Close() error {
+	return r.client.Close()
+}
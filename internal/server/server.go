@@ -1,43 +1,125 @@
 package server
 
 import (
-	"bytes"
+	"cmp"
 	"context"
-	"errors"
 	"fmt"
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
-	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/lxzan/gws"
 	slogecho "github.com/samber/slog-echo"
+	"github.com/znowdev/reqbouncer/internal/authn"
 	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/tracing"
 	"github.com/znowdev/reqbouncer/internal/wire"
 	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var connectedClients atomic.Int32
-
 type Config struct {
 	GithubClientid     string
 	GithubUserProvider auth.GithubUserProvider
-	CiTestToken        string
-	Port               string
+	// Auth selects the provider authenticating client tokens. GitHub users
+	// are looked up with GithubUserProvider.
+	Auth authn.Config
+	// SessionSecret signs the session tokens exchanged for provider tokens
+	// at login. Instances sharing clients need the same secret, at least 32
+	// bytes long. When empty a random one is used.
+	SessionSecret string
+	// SessionTTL is how long sessions last. When zero
+	// authn.DefaultSessionTTL is used. Revoked sessions are kept in redis
+	// with the redis PubSub backend, otherwise revocations only last until
+	// the instance restarts.
+	SessionTTL time.Duration
+	// SessionRecheck is how often the access of the users of sessions is
+	// checked again with the provider, so users removed from the GitHub
+	// organizations or teams of Auth lose access within it. When zero
+	// authn.DefaultSessionRecheck is used if Auth restricts access to
+	// GitHub organizations or teams, else access is only checked at login.
+	// The provider tokens it needs are kept in redis with the redis PubSub
+	// backend, otherwise in the memory of the instance that issued them.
+	SessionRecheck time.Duration
+	CiTestToken    string
+	Port           string
+	// TCPPortRange is the range of public ports allocated to TCP tunnels,
+	// e.g. "20000-20100". When empty any free port is used.
+	TCPPortRange string
+	// InspectHistory is the number of requests recorded per tunnel for the
+	// inspection API. When zero inspect.DefaultHistory is used.
+	InspectHistory int
+	// OfflineQueueTTL bounds how long requests are queued for clients that
+	// opted into offline queueing. When zero an hour is used. With the redis
+	// PubSub backend queues are kept in redis, surviving restarts and
+	// reaching clients reconnecting to any instance. Otherwise they are kept
+	// in memory and lost when the instance stops.
+	OfflineQueueTTL time.Duration
+	// OfflineQueueSize is the number of requests queued per subdomain. When
+	// zero 100 requests are kept.
+	OfflineQueueSize int
+	// PubSub selects the bus requests are relayed over, one of the pubsub
+	// backends. Instances sharing a redis or nats bus at PubSubURL forward
+	// requests to clients connected to any of them.
+	PubSub    string
+	PubSubURL string
+	// AdminLogins are the users allowed to use the /_admin API. The
+	// API is disabled when empty.
+	AdminLogins []string
+	// BlockedLogins are the users that may not open tunnels. More can
+	// be blocked at runtime through the admin API.
+	BlockedLogins []string
+	// MetricsAddr is an address Prometheus metrics are served on without
+	// authentication, e.g. ":9090". The metrics are always served to
+	// administrators on /_admin/metrics of the public port.
+	MetricsAddr string
+	// Tracing selects where the spans of forwarded requests are exported.
+	Tracing tracing.Config
+	// ShutdownTimeout bounds how long in-flight requests are waited for on
+	// shutdown. When zero DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+	// MinProtocolVersion is the oldest client protocol version accepted,
+	// older clients are asked to upgrade. When zero wire.MinProtocolVersion
+	// is used.
+	MinProtocolVersion int
 	Debug              bool
 }
 
+// Start runs the server until it receives SIGTERM or an interrupt, then
+// shuts it down gracefully.
 func Start(logger *slog.Logger, cfg Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return Run(ctx, logger, cfg)
+}
+
+// Run runs the server until ctx is done, then stops accepting requests,
+// waits for the in-flight ones and sends the connected clients away.
+func Run(ctx context.Context, logger *slog.Logger, cfg Config) error {
 	logger = logger.With("component", "server")
+	minProtocolVersion := cmp.Or(cfg.MinProtocolVersion, wire.MinProtocolVersion)
+	if minProtocolVersion > wire.ProtocolVersion {
+		return fmt.Errorf("min protocol version %d is newer than protocol version %d of this server", minProtocolVersion, wire.ProtocolVersion)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), "reqbouncer-server", cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	e := echo.New()
 	e.Use(subdomainMw)
+	e.Use(fullDuplexMw)
 	e.Use(slogecho.NewWithConfig(logger, slogecho.Config{
 		DefaultLevel:       slog.LevelInfo,
 		ClientErrorLevel:   slog.LevelWarn,
@@ -48,8 +130,8 @@ func Start(logger *slog.Logger, cfg Config) error {
 		WithRequestHeader:  false,
 		WithResponseBody:   false,
 		WithResponseHeader: false,
-		WithSpanID:         false,
-		WithTraceID:        false,
+		WithSpanID:         cfg.Tracing.Enabled(),
+		WithTraceID:        cfg.Tracing.Enabled(),
 		Filters: []slogecho.Filter{
 			slogecho.IgnorePath("/healthz"),
 			IgnoreUserAgent("Mozilla/5.0 (compatible; CensysInspect/1.1; +https://about.censys.io/)"),
@@ -57,22 +139,71 @@ func Start(logger *slog.Logger, cfg Config) error {
 	}))
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORS())
-	e.Use(middleware.Gzip())
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{Skipper: isForwardedRequest}))
 	e.Use(middleware.Secure())
 	e.Use(middleware.RequestID())
-	e.Use(middleware.BodyLimit("1M"))
-	e.Use(middleware.Decompress())
-	pubSub := gochannel.NewGoChannel(
-		gochannel.Config{},
-		watermill.NewStdLogger(false, false),
-	)
+	e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{Skipper: isForwardedRequest, Limit: "1M"}))
+	e.Use(middleware.DecompressWithConfig(middleware.DecompressConfig{Skipper: isForwardedRequest}))
+	pubSub, err := pubsub.New(pubsub.Config{Backend: cfg.PubSub, URL: cfg.PubSubURL})
+	if err != nil {
+		return err
+	}
+	defer pubSub.Close()
+
+	cm := &clientMap{pools: make(map[string]*clientPool)}
+	m := newMetrics(cm)
+	// runCtx stops the background work of the instance once it shut down.
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.MetricsAddr != "" {
+		if err := m.Serve(runCtx, cfg.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	cl := newCluster(cm, pubSub)
+	if err := cl.Run(runCtx); err != nil {
+		return err
+	}
+
+	tcpPorts, err := parsePortRange(cfg.TCPPortRange)
+	if err != nil {
+		return err
+	}
 
-	cm := &clientMap{clients: make(map[string]struct{})}
+	var queueURL string
+	if cfg.PubSub == pubsub.BackendRedis {
+		queueURL = cfg.PubSubURL
+	}
+	offline, err := newOfflineQueue(cfg.OfflineQueueTTL, cfg.OfflineQueueSize, queueURL)
+	if err != nil {
+		return err
+	}
+	defer offline.Close()
+	sessionCfg := authn.SessionConfig{Secret: cfg.SessionSecret, TTL: cfg.SessionTTL, Recheck: cfg.SessionRecheck}
+	if sessionCfg.Recheck == 0 && cfg.Auth.GitHub.Restricted() && cmp.Or(cfg.Auth.Provider, authn.ProviderGitHub) == authn.ProviderGitHub {
+		sessionCfg.Recheck = authn.DefaultSessionRecheck
+	}
+	if cfg.PubSub == pubsub.BackendRedis {
+		revocations, err := newRedisRevocations(cfg.PubSubURL)
+		if err != nil {
+			return err
+		}
+		defer revocations.Close()
+		sessionCfg.Revocations = revocations
+		credentials, err := newRedisCredentials(cfg.PubSubURL)
+		if err != nil {
+			return err
+		}
+		defer credentials.Close()
+		sessionCfg.Credentials = credentials
+	}
+	blocked := newBlocklist(cfg.BlockedLogins)
+	inspector := inspect.NewStore(cfg.InspectHistory)
 
-	upgrader := gws.NewUpgrader(&Handler{cm, pubSub}, &gws.ServerOption{
+	upgrader := gws.NewUpgrader(&Handler{clientMap: cm, cluster: cl, pubSub: pubSub, tcpPorts: tcpPorts, offline: offline, metrics: m}, &gws.ServerOption{
 		WriteBufferSize:     0,
 		PermessageDeflate:   gws.PermessageDeflate{Enabled: true}, // Enable compression
-		ParallelEnabled:     true,                                 // Parallel message processing
+		ParallelEnabled:     false,                                // Frames are published in order by a frameRelay
 		ParallelGolimit:     0,
 		ReadMaxPayloadSize:  0,
 		ReadBufferSize:      0,
@@ -83,13 +214,36 @@ func Start(logger *slog.Logger, cfg Config) error {
 		TlsConfig:           nil,
 		HandshakeTimeout:    time.Second * 5,
 		SubProtocols:        nil,
-		ResponseHeader:      nil,
+		ResponseHeader:      handshakeHeader(),
 		Authorize:           nil,
 		NewSession:          nil,
 	})
-	srv := &server{upgrader, cfg.GithubClientid, pubSub, cm}
+	srv := &server{
+		Upgrader:       upgrader,
+		githubClientid: cfg.GithubClientid,
+		pubSub:         pubSub,
+		clientMap:      cm,
+		inspector:      inspector,
+		metrics:        m,
+	}
+	go srv.evictHistory(runCtx)
 
-	authMw := newAuthMiddleware(cfg.CiTestToken, cfg.GithubUserProvider)
+	provider, err := authn.New(runCtx, cfg.Auth, cfg.GithubUserProvider)
+	if err != nil {
+		return err
+	}
+	sessions, err := authn.NewSessions(sessionCfg)
+	if err != nil {
+		return err
+	}
+	authenticator := sessions.Authenticator(provider, cmp.Or(cfg.Auth.Provider, authn.ProviderGitHub))
+
+	adm := &admin{cluster: cl, clientMap: cm, inspector: inspector, blocked: blocked, sessions: sessions, pubSub: pubSub}
+	if err := adm.Run(runCtx); err != nil {
+		return err
+	}
+	sess := &sessionAPI{sessions: sessions, provider: provider, blocked: blocked, admin: adm}
+	authMw := newAuthMiddleware(cfg.CiTestToken, authenticator, blocked)
 
 	//myRouter.HandleFunc("/debug/pprof/", pprof.Index)
 	//myRouter.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -107,16 +261,33 @@ func Start(logger *slog.Logger, cfg Config) error {
 
 	e.GET("/_config", srv.configHandler)
 	e.GET("/_health", srv.healthHandler)
-	e.GET("/_websocket", srv.handleSockets, authMw, checkSubDomain(cm))
-	e.RouteNotFound("/*", srv.forwardRequest, ensureSubdomainHasListeners(cm))
-
-	err := e.Start(":" + cfg.Port)
-	if err != nil {
+	e.POST("/_auth/session", sess.createSession, m.countAuthFailures)
+	e.DELETE("/_auth/session", sess.deleteSession, m.countAuthFailures)
+	e.GET("/_websocket", srv.handleSockets, checkProtocolVersion(minProtocolVersion), m.countAuthFailures, authMw, checkSubDomain(cm))
+	e.GET("/_api/tunnels/:subdomain/requests", srv.listRequests, m.countAuthFailures, newTunnelOwnerMiddleware(cfg.CiTestToken, authenticator, blocked))
+	if len(cfg.AdminLogins) > 0 {
+		g := e.Group("/_admin", m.countAuthFailures, newAdminMiddleware(cfg.AdminLogins, authenticator, blocked))
+		g.GET("/tunnels", adm.listTunnels)
+		g.GET("/tunnels/:subdomain", adm.getTunnel)
+		g.DELETE("/tunnels/:subdomain", adm.disconnectTunnel)
+		g.GET("/blocked", adm.listBlocked)
+		g.PUT("/blocked/:login", adm.blockLogin)
+		g.DELETE("/blocked/:login", adm.unblockLogin)
+		g.DELETE("/sessions/:login", adm.revokeSessions)
+		g.GET("/metrics", echo.WrapHandler(m.Handler()))
+	}
+	e.RouteNotFound("/*", srv.forwardRequest, ensureSubdomainHasListeners(cm, offline))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.Start(":" + cfg.Port)
+	}()
+	select {
+	case err := <-errs:
 		return err
+	case <-ctx.Done():
 	}
-
-	return nil
-
+	return shutdown(logger, e, cm, cmp.Or(cfg.ShutdownTimeout, DefaultShutdownTimeout))
 }
 func IgnoreUserAgent(urls ...string) slogecho.Filter {
 	return func(c echo.Context) bool {
@@ -142,23 +313,59 @@ func checkSubDomain(cm *clientMap) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			subdomain := c.Get("subdomain").(string)
-			if cm.HasClient(subdomain) {
-				slog.Error("client already connected", slog.Any("subdomain", subdomain))
-				return c.JSON(http.StatusConflict, echo.Map{"error": "client already connected"})
+			if err := cm.CanJoin(subdomain, c.Request().Header.Get(wire.PoolHeader)); err != nil {
+				slog.Error("client already connected", slog.Any("subdomain", subdomain), slog.Any("error", err))
+				return c.JSON(http.StatusConflict, echo.Map{"error": err.Error()})
 			}
 			return next(c)
 		}
 	}
 }
 
-func ensureSubdomainHasListeners(cm *clientMap) echo.MiddlewareFunc {
+// handshakeHeader advertises the server's protocol version and capabilities
+// on every websocket upgrade response.
+func handshakeHeader() http.Header {
+	h := http.Header{}
+	h.Set(wire.VersionHeader, strconv.Itoa(wire.ProtocolVersion))
+	h.Set(wire.CapabilitiesHeader, wire.SupportedCapabilities.String())
+	return h
+}
+
+// checkProtocolVersion asks clients older than protocol version min to
+// upgrade.
+func checkProtocolVersion(min int) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			version, err := wire.ParseVersion(c.Request().Header.Get(wire.VersionHeader))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "malformed protocol version")
+			}
+			if version < min {
+				slog.Info("rejecting outdated client", slog.Int("protocol_version", version))
+				return c.JSON(http.StatusUpgradeRequired, echo.Map{"error": fmt.Sprintf(
+					"client protocol version %d is no longer supported (server requires %d or newer), please upgrade reqbouncer",
+					version, min)})
+			}
+			return next(c)
+		}
+	}
+}
+
+func ensureSubdomainHasListeners(cm *clientMap, offline offlineQueue) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			subdomain := c.Get("subdomain").(string)
-			if !cm.HasClient(subdomain) {
+			client, ok := cm.Client(subdomain)
+			if !ok && offline.Accepting(subdomain) && !isWebSocketUpgrade(c.Request()) {
+				return queueRequest(c, offline, subdomain)
+			}
+			if !ok {
 				slog.Error("no clients connected for subdomain", slog.Any("subdomain", subdomain))
 				return c.JSON(http.StatusConflict, echo.Map{"error": fmt.Sprintf("no clients connected for host'%s'", c.Request().Host)})
 			}
+			if client.Tunnel == wire.TunnelTCP {
+				return c.JSON(http.StatusConflict, echo.Map{"error": fmt.Sprintf("the tunnel for host '%s' forwards raw tcp", c.Request().Host)})
+			}
 			return next(c)
 		}
 	}
@@ -171,78 +378,147 @@ const (
 
 const (
 	CloseNormalClosure = 1000
+	CloseGoingAway     = 1001
 )
 
 type Handler struct {
 	clientMap *clientMap
-	pubSub    *gochannel.GoChannel
+	cluster   *cluster
+	pubSub    pubsub.PubSub
+	tcpPorts  portRange
+	offline   offlineQueue
+	metrics   *metrics
 }
 
-var clientConnMux = sync.Mutex{}
-var clientConns = make(map[*gws.Conn]string)
-
 func (c *Handler) OnOpen(socket *gws.Conn) {
 	slog.Debug("socket opened")
-	clientConnMux.Lock()
-	defer clientConnMux.Unlock()
-	clientConns[socket] = socket.RemoteAddr().String()
 	_ = socket.SetDeadline(time.Now().Add(PingInterval + PingWait))
 	v, ok := socket.Session().Load("subdomain")
 	if ok {
 
-		if c.clientMap.HasClient(v.(string)) {
-			slog.Info("client already connected for subdomain", slog.Any("subdomain", v))
-			socket.WriteClose(CloseNormalClosure, []byte("client already connected"))
+		tunnel, _ := socket.Session().Load("tunnel")
+		pool, _ := socket.Session().Load("pool")
+		remoteAddr, _ := socket.Session().Load("remote_addr")
+		version, _ := socket.Session().Load("client_version")
+		inflight := newInflightRequests()
+		member := &poolMember{
+			Topic:    uuid.NewString(),
+			Info:     clientInfo{Capabilities: capabilitiesOf(socket), Tunnel: tunnel.(string)},
+			Presence: newPresence(remoteAddr.(string), version.(string)),
+			inflight: inflight,
+			socket:   socket,
+		}
+		if err := c.clientMap.AddClient(v.(string), pool.(string), member); err != nil {
+			slog.Info("client already connected for subdomain", slog.Any("subdomain", v), slog.Any("error", err))
+			socket.WriteClose(CloseNormalClosure, []byte(err.Error()))
 			defer socket.NetConn().Close()
 			return
 		}
-		slog.Info("socket connected to subdomain", slog.Any("subdomain", v))
-		c.clientMap.AddClient(v.(string))
-
-		ctx := context.Background()
+		slog.Info("socket connected to subdomain", slog.Any("subdomain", v), slog.String("pool", pool.(string)))
+		c.metrics.Connected(v.(string))
+		c.cluster.Announce()
+
+		codec := codecOf(socket)
+		socket.Session().Store("topic", member.Topic)
+		socket.Session().Store("inflight", inflight)
+		ctx, cancel := context.WithCancel(context.Background())
+		socket.Session().Store("cancel", cancel)
 		var clientMessages <-chan *message.Message
-		clientMessages, err := c.pubSub.Subscribe(ctx, v.(string))
+		clientMessages, err := c.pubSub.Subscribe(ctx, member.Topic)
 		if err != nil {
+			slog.Error("failed to subscribe to client topic", slog.Any("error", err))
 			socket.WriteClose(CloseNormalClosure, []byte("could not subscribe to client topic"))
+			return
+		}
+
+		offlineStatus, _ := socket.Session().Load("offline_status")
+		if err := c.offline.Connected(v.(string), offlineStatus.(int)); err != nil {
+			slog.Error("failed to update offline queue", slog.Any("error", err))
 		}
 
+		// Requests queued while the client was offline are delivered next to
+		// the live ones, so a large backlog does not hold up live traffic.
 		go func() {
-			for {
-				select {
-				case msg := <-clientMessages:
-					slog.Debug("sending client message", slog.Any("message_id", msg.UUID))
-
-					wireMsg := wire.WireMessage{
-						ID:      msg.UUID,
-						Payload: msg.Payload,
-					}
-
-					bytes, err := wireMsg.Serialize()
-					if err != nil {
-						slog.Error("failed to serialize message", slog.Any("error", err))
-						continue
-					}
-
-					err = socket.WriteMessage(gws.OpcodeBinary, bytes)
-					if err != nil {
-						slog.Error("failed to write message", slog.Any("error", err))
-						continue
-					}
+			if !c.deliverQueued(ctx, socket, codec, v.(string)) {
+				socket.NetConn().Close()
+			}
+		}()
+		go func() {
+			for msg := range clientMessages {
+				slog.Debug("sending client message", slog.Any("message_id", msg.UUID))
+
+				frame := frameFromMessage(msg)
+				switch frame.Type {
+				case wire.FrameHTTP, wire.FrameHead, wire.FrameOpen:
+					inflight.Add(frame.ID)
+				case wire.FrameCancel:
+					inflight.Remove(frame.ID)
+				}
+
+				bytes, err := codec.Encode(frame)
+				if err != nil {
+					slog.Error("failed to serialize message", slog.Any("error", err))
 					msg.Ack()
+					continue
+				}
 
+				err = socket.WriteMessage(gws.OpcodeBinary, bytes)
+				if err != nil {
+					slog.Error("failed to write message", slog.Any("error", err))
+					msg.Nack()
+					socket.NetConn().Close()
+					return
 				}
+				msg.Ack()
 			}
 		}()
+
+		if tunnel == wire.TunnelTCP {
+			if err := c.openTCPListener(socket, member.Topic); err != nil {
+				slog.Error("failed to open tcp listener", slog.Any("error", err))
+				socket.WriteClose(CloseNormalClosure, []byte("could not allocate a tcp port"))
+			}
+		}
 	}
 
 }
 
 func (c *Handler) OnClose(socket *gws.Conn, err error) {
 	slog.Debug("connection closed", slog.Any("error", err))
+	if relay, ok := socket.Session().Load("relay"); ok {
+		relay.(*frameRelay).Close()
+	}
 	v, ok := socket.Session().Load("subdomain")
-	if ok {
+	cancel, registered := socket.Session().Load("cancel")
+	if ok && registered {
 		slog.Info("socket closed", slog.Any("subdomain", v))
-		c.clientMap.RemoveClient(v.(string))
+		cancel.(context.CancelFunc)()
+		closeTCPListener(socket)
+		topic, _ := socket.Session().Load("topic")
+		c.clientMap.RemoveClient(v.(string), topic.(string))
+		c.cluster.Announce()
+		if !c.clientMap.HasClient(v.(string)) {
+			if err := c.offline.Disconnected(v.(string)); err != nil {
+				slog.Error("failed to update offline queue", slog.Any("error", err))
+			}
+			c.metrics.Disconnected(v.(string))
+		}
+		c.abortInflight(socket)
+	}
+}
+
+// abortInflight releases the callers still waiting on responses from socket.
+func (c *Handler) abortInflight(socket *gws.Conn) {
+	inflight, ok := socket.Session().Load("inflight")
+	if !ok {
+		return
+	}
+	for _, requestId := range inflight.(*inflightRequests).Drain() {
+		msg := message.NewMessage(watermill.NewUUID(), nil)
+		msg.Metadata.Set(metadataAbort, errClientLost.Error())
+		if err := c.pubSub.Publish(requestId, msg); err != nil {
+			slog.Error("failed to publish abort", slog.Any("error", err), slog.String("request_id", requestId))
+		}
 	}
 }
 
@@ -250,6 +526,10 @@ func (c *Handler) OnPing(socket *gws.Conn, payload []byte) {
 	//slog.Debug("received ping")
 	_ = socket.SetDeadline(time.Now().Add(PingInterval + PingWait))
 	_ = socket.WritePong(nil)
+	if topic, ok := socket.Session().Load("topic"); ok {
+		subdomain, _ := socket.Session().Load("subdomain")
+		c.clientMap.Heartbeat(subdomain.(string), topic.(string))
+	}
 }
 
 func (c *Handler) OnPong(socket *gws.Conn, payload []byte) {
@@ -267,26 +547,44 @@ func (c *Handler) OnMessage(socket *gws.Conn, wsmsg *gws.Message) {
 
 	slog.Debug("received binary message", slog.Any("content", string(wsmsg.Bytes())))
 	var wireMsg wire.WireMessage
-	if err := wireMsg.Deserialize(wsmsg.Bytes()); err != nil {
+	if err := codecOf(socket).Decode(wsmsg.Bytes(), &wireMsg); err != nil {
 		slog.Error("failed to deserialize message", slog.Any("error", err))
 		return
 	}
-	msg := message.NewMessage(wireMsg.ID, wireMsg.Payload)
-	slog.Debug("publishing message", slog.Any("message_id", msg.UUID))
-	err := c.pubSub.Publish(wireMsg.ID, msg)
-	if err != nil {
-		slog.Error("failed to publish message", slog.Any("error", err))
-		return
+	if wireMsg.Type == wire.FrameHTTP || wireMsg.Type.IsFinal() {
+		if inflight, ok := socket.Session().Load("inflight"); ok {
+			inflight.(*inflightRequests).Remove(wireMsg.ID)
+		}
+	}
+
+	relay, ok := socket.Session().Load("relay")
+	if !ok {
+		relay = newFrameRelay(c.pubSub)
+		socket.Session().Store("relay", relay)
+	}
+	relay.(*frameRelay).Relay(wireMsg)
+}
+
+// capabilitiesOf returns the capabilities negotiated for socket during the handshake.
+func capabilitiesOf(socket *gws.Conn) wire.Capabilities {
+	if v, ok := socket.Session().Load("capabilities"); ok {
+		return v.(wire.Capabilities)
 	}
-	return
+	return nil
+}
 
+// codecOf returns the wire codec negotiated for socket during the handshake.
+func codecOf(socket *gws.Conn) wire.Codec {
+	return capabilitiesOf(socket).Codec()
 }
 
 type server struct {
 	*gws.Upgrader
 	githubClientid string
-	pubSub         *gochannel.GoChannel
+	pubSub         pubsub.PubSub
 	clientMap      *clientMap
+	inspector      *inspect.Store
+	metrics        *metrics
 }
 
 func (s *server) healthHandler(c echo.Context) error {
@@ -297,65 +595,54 @@ func (s *server) configHandler(c echo.Context) error {
 	return c.JSON(200, echo.Map{"github_client_id": s.githubClientid})
 }
 
-func (s *server) forwardRequest(c echo.Context) error {
-	requestId := uuid.NewString()
-
-	buf := new(bytes.Buffer)
-	err := c.Request().Write(buf)
-	if err != nil {
-		return err
+func (ws *server) handleSockets(c echo.Context) error {
+	capabilities := wire.SupportedCapabilities.Intersect(wire.ParseCapabilities(c.Request().Header.Get(wire.CapabilitiesHeader)))
+
+	tunnel := c.Request().Header.Get(wire.TunnelHeader)
+	switch tunnel {
+	case "", wire.TunnelHTTP:
+		tunnel = wire.TunnelHTTP
+	case wire.TunnelTCP:
+		if !capabilities.Has(wire.CapTCP) {
+			return echo.NewHTTPError(http.StatusBadRequest, "tcp tunnels require the tcp capability")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown tunnel type %q", tunnel))
 	}
 
-	msg := message.NewMessage(requestId, buf.Bytes())
-
-	slog.Debug("publishing message", slog.Any("message_id", msg.UUID))
-	err = s.pubSub.Publish(c.Get("subdomain").(string), msg)
-	if err != nil {
-		return err
+	pool := c.Request().Header.Get(wire.PoolHeader)
+	if pool != "" && !wire.ValidPoolStrategy(pool) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown pool strategy %q", pool))
 	}
-
-	msgs, err := s.pubSub.Subscribe(c.Request().Context(), requestId)
-	if err != nil {
-		return err
+	if pool != "" && tunnel == wire.TunnelTCP {
+		return echo.NewHTTPError(http.StatusBadRequest, "tcp tunnels cannot be pooled")
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request().Context(), 60*time.Second)
-	defer cancel()
-
-	for {
-		select {
-		case <-c.Request().Context().Done():
-			return c.Request().Context().Err()
-		case msg := <-msgs:
-			slog.Debug("received response", slog.Any("message_id", msg.UUID))
-
-			hj, ok := c.Response().Writer.(http.Hijacker)
-			if !ok {
-				return errors.New("webserver does not support hijacking")
-			}
-			conn, bufrw, err := hj.Hijack()
-			if err != nil {
-				return err
-			}
-			defer conn.Close()
-			fmt.Fprintf(bufrw, "%s", msg.Payload)
-			bufrw.Flush()
-			conn.Close()
-			return nil
-		case <-ctx.Done():
-			return ctx.Err()
+	var offlineStatus int
+	if v := c.Request().Header.Get(wire.OfflineQueueHeader); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 200 || status > 599 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid offline queue status %q", v))
+		}
+		if tunnel == wire.TunnelTCP {
+			return echo.NewHTTPError(http.StatusBadRequest, "tcp tunnels cannot queue requests")
 		}
+		offlineStatus = status
 	}
 
-}
-
-func (ws *server) handleSockets(c echo.Context) error {
 	socket, err := ws.Upgrade(c.Response(), c.Request())
 	if err != nil {
 		return err
 	}
 
 	socket.Session().Store("subdomain", c.Get("subdomain"))
+	socket.Session().Store("capabilities", capabilities)
+	socket.Session().Store("tunnel", tunnel)
+	socket.Session().Store("pool", pool)
+	socket.Session().Store("offline_status", offlineStatus)
+	socket.Session().Store("remote_addr", c.RealIP())
+	socket.Session().Store("client_version", c.Request().Header.Get(wire.ClientVersionHeader))
+	slog.Debug("negotiated capabilities", slog.String("capabilities", capabilities.String()))
 
 	socket.ReadLoop()
 
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/znowdev/reqbouncer/internal/authn"
+	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
+	"github.com/znowdev/reqbouncer/internal/slogger"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer runs a server with cfg on a free port until the test ends and
+// returns its address once it is healthy.
+func startServer(t *testing.T, cfg Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	logger, _ := slogger.NewSlogger(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Run(ctx, logger, cfg)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	})
+
+	addr := "localhost:" + cfg.Port
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + "/_health")
+		if err == nil {
+			resp.Body.Close()
+			return addr
+		}
+	}
+	t.Fatalf("server on %s did not become healthy", addr)
+	return ""
+}
+
+// get requests path of the server at addr with token and returns the status.
+func get(t *testing.T, addr, path, token string) int {
+	t.Helper()
+	status, err := request(addr, path, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// request is get for goroutines other than the test's.
+func request(addr, path, token string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(wire.VersionHeader, strconv.Itoa(wire.ProtocolVersion))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestServer_ProtocolVersion(t *testing.T) {
+	addr := startServer(t, Config{
+		GithubUserProvider: func(token string) (auth.GitHubUser, error) {
+			return auth.GitHubUser{Login: "alice"}, nil
+		},
+		MinProtocolVersion: 1,
+	})
+
+	for _, tt := range []struct {
+		version string
+		want    int
+	}{
+		{"", http.StatusUpgradeRequired},
+		{"0", http.StatusUpgradeRequired},
+		{strconv.Itoa(wire.ProtocolVersion), http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/_websocket", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer gho_alice")
+		if tt.version != "" {
+			req.Header.Set(wire.VersionHeader, tt.version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// Current clients get past the check and fail the upgrade, as this
+		// is no websocket.
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET /_websocket with version %q got = %d, want %d", tt.version, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUpgradeRequired && !strings.Contains(string(body), "please upgrade") {
+			t.Errorf("GET /_websocket with version %q got body %s, want it to ask for an upgrade", tt.version, body)
+		}
+	}
+
+	if err := Run(context.Background(), slog.Default(), Config{MinProtocolVersion: wire.ProtocolVersion + 1}); err == nil {
+		t.Errorf("Run() with a min protocol version newer than the server succeeded")
+	}
+}
+
+func TestServer_StaticTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("alice alice-token\nbob bob-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, Config{
+		Auth: authn.Config{
+			Provider:  authn.ProviderStatic,
+			TokenFile: tokenFile,
+		},
+		AdminLogins: []string{"alice"},
+	})
+
+	for _, tt := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/_admin/tunnels", "alice-token", http.StatusOK},
+		{"/_admin/tunnels", "bob-token", http.StatusForbidden},
+		{"/_admin/tunnels", "mallory-token", http.StatusUnauthorized},
+		{"/_websocket", "mallory-token", http.StatusUnauthorized},
+	} {
+		if got := get(t, addr, tt.path, tt.token); got != tt.want {
+			t.Errorf("GET %s with %s got = %d, want %d", tt.path, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestServer_GitHubLookupCache(t *testing.T) {
+	// Stand-in for api.github.com counting the user lookups.
+	var lookups atomic.Int32
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path != "/user" || r.Header.Get("Authorization") != "Bearer gho_alice" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(auth.GitHubUser{Login: "alice"})
+	}))
+	defer github.Close()
+	addr := startServer(t, Config{
+		GithubUserProvider: auth.NewGitHubUserProvider(github.URL),
+		AdminLogins:        []string{"alice"},
+	})
+
+	// Concurrent lookups of a token share one request.
+	type result struct {
+		status int
+		err    error
+	}
+	results := make(chan result, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			status, err := request(addr, "/_admin/tunnels", "gho_alice")
+			results <- result{status, err}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if got := <-results; got.err != nil || got.status != http.StatusOK {
+			t.Errorf("concurrent GET got = %d, %v, want 200", got.status, got.err)
+		}
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("concurrent lookups hit GitHub %d times, want 1", got)
+	}
+
+	// Known tokens are served from the cache.
+	if got := get(t, addr, "/_admin/tunnels", "gho_alice"); got != http.StatusOK {
+		t.Errorf("cached GET got = %d, want 200", got)
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("cached token hit GitHub %d times, want 1", got)
+	}
+
+	// Rejected tokens are cached too.
+	for i := 0; i < 2; i++ {
+		if got := get(t, addr, "/_admin/tunnels", "gho_expired"); got != http.StatusUnauthorized {
+			t.Errorf("GET with rejected token got = %d, want 401", got)
+		}
+	}
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("rejected token hit GitHub %d times, want 1", got-1)
+	}
+}
+
+func TestServer_Sessions(t *testing.T) {
+	// Stand-in for api.github.com counting the user lookups.
+	var lookups atomic.Int32
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		login := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer gho_")
+		json.NewEncoder(w).Encode(auth.GitHubUser{Login: login})
+	}))
+	defer github.Close()
+	addr := startServer(t, Config{
+		GithubUserProvider: auth.NewGitHubUserProvider(github.URL),
+		AdminLogins:        []string{"alice", "bob"},
+		SessionSecret:      strings.Repeat("s", 32),
+	})
+
+	t.Run("Sessions authenticate without asking GitHub", func(t *testing.T) {
+		session, err := auth.StartSession(addr, "gho_alice")
+		if err != nil {
+			t.Fatalf("StartSession() error = %v", err)
+		}
+		if session.Login != "alice" || !session.ExpiresAt.After(time.Now()) {
+			t.Errorf("StartSession() got = %+v, want an unexpired session of alice", session)
+		}
+
+		before := lookups.Load()
+		for i := 0; i < 3; i++ {
+			if got := get(t, addr, "/_admin/tunnels", session.Token); got != http.StatusOK {
+				t.Errorf("GET with session got = %d, want 200", got)
+			}
+		}
+		if got := lookups.Load(); got != before {
+			t.Errorf("sessions hit GitHub %d times, want 0", got-before)
+		}
+	})
+
+	t.Run("Sessions cannot be renewed with a session token", func(t *testing.T) {
+		session, err := auth.StartSession(addr, "gho_alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := auth.StartSession(addr, session.Token); err == nil {
+			t.Errorf("StartSession() with a session token succeeded")
+		}
+	})
+
+	t.Run("Ended sessions are rejected", func(t *testing.T) {
+		session, err := auth.StartSession(addr, "gho_alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := auth.EndSession(addr, session.Token); err != nil {
+			t.Fatalf("EndSession() error = %v", err)
+		}
+		if got := get(t, addr, "/_admin/tunnels", session.Token); got != http.StatusUnauthorized {
+			t.Errorf("GET with ended session got = %d, want 401", got)
+		}
+	})
+
+	t.Run("Admins revoke every session of a login", func(t *testing.T) {
+		admin, err := auth.StartSession(addr, "gho_alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := auth.StartSession(addr, "gho_bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, addr, "/_admin/tunnels", session.Token); got != http.StatusOK {
+			t.Fatalf("GET with session of bob got = %d, want 200", got)
+		}
+
+		req, err := http.NewRequest(http.MethodDelete, "http://"+addr+"/_admin/sessions/bob", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+admin.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("DELETE /_admin/sessions/bob got = %d, want 204", resp.StatusCode)
+		}
+
+		if got := get(t, addr, "/_admin/tunnels", session.Token); got != http.StatusUnauthorized {
+			t.Errorf("GET with revoked session got = %d, want 401", got)
+		}
+		if got := get(t, addr, "/_admin/tunnels", admin.Token); got != http.StatusOK {
+			t.Errorf("GET with session of another login got = %d, want 200", got)
+		}
+	})
+}
+
+func TestServer_SessionRevocationsInRedis(t *testing.T) {
+	cfg := Config{
+		GithubUserProvider: func(token string) (auth.GitHubUser, error) {
+			return auth.GitHubUser{Login: strings.TrimPrefix(token, "gho_")}, nil
+		},
+		AdminLogins:   []string{"alice"},
+		SessionSecret: strings.Repeat("s", 32),
+		PubSub:        pubsub.BackendRedis,
+		PubSubURL:     "redis://" + miniredis.RunT(t).Addr(),
+	}
+	addr := startServer(t, cfg)
+	session, err := auth.StartSession(addr, "gho_bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.EndSession(addr, session.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Instances starting after the revocation do not accept the session
+	// either.
+	later := startServer(t, cfg)
+	if got := get(t, later, "/_admin/tunnels", session.Token); got != http.StatusUnauthorized {
+		t.Errorf("GET with session ended before the instance started got = %d, want 401", got)
+	}
+}
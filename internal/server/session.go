@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/authn"
+	"log/slog"
+	"net/http"
+)
+
+// sessionAPI exchanges the tokens of the identity provider for session
+// tokens, so clients do not keep the former around.
+type sessionAPI struct {
+	sessions *authn.Sessions
+	provider authn.Authenticator
+	blocked  *blocklist
+	admin    *admin
+}
+
+// createSession starts a session for the user of the provider token the
+// caller presents.
+func (s *sessionAPI) createSession(c echo.Context) error {
+	token, err := bearerToken(c)
+	if err != nil {
+		return err
+	}
+	// Sessions are not renewed, users have to log in again once theirs
+	// expired.
+	if _, ok, _ := s.sessions.Verify(token); ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "sessions can only be started with a token of the identity provider")
+	}
+	user, err := authenticate(c, s.provider, token)
+	if err != nil {
+		return err
+	}
+	if s.blocked.Blocked(user.Login) {
+		slog.Warn("rejected blocked user", slog.String("login", user.Login))
+		return echo.NewHTTPError(http.StatusForbidden, "login blocked by an administrator")
+	}
+
+	session, err := s.sessions.Issue(user, token)
+	if err != nil {
+		return err
+	}
+	slog.Info("session started", slog.String("login", user.Login), slog.String("session", session.ID))
+	return c.JSON(http.StatusCreated, session)
+}
+
+// deleteSession revokes the session of the caller on every instance.
+func (s *sessionAPI) deleteSession(c echo.Context) error {
+	token, err := bearerToken(c)
+	if err != nil {
+		return err
+	}
+	session, ok, err := s.sessions.Verify(token)
+	if !ok || err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid session token")
+	}
+	if err := s.admin.execute(adminCommand{Action: actionRevokeSession, Session: session.ID}); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/lxzan/gws"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"log/slog"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests are waited for when
+// the server shuts down.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// disconnectWait bounds how long the closed clients are waited for to be
+// removed, so the other instances learn they left before the pubsub closes.
+const disconnectWait = time.Second
+
+// reasonGoingAway is sent to the clients of a server shutting down.
+const reasonGoingAway = "server going away, reconnect elsewhere"
+
+// shutdown stops e from accepting requests, waits up to timeout for the
+// in-flight ones and then sends the local clients away.
+func shutdown(logger *slog.Logger, e *echo.Echo, cm *clientMap, timeout time.Duration) error {
+	logger.Info("shutting down, draining in-flight requests", slog.Duration("timeout", timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		logger.Warn("in-flight requests did not finish in time, dropping them")
+		_ = e.Close()
+	}
+
+	cm.GoAway()
+	deadline := time.Now().Add(disconnectWait)
+	for cm.ConnectedClientsNo() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logger.Info("server stopped")
+	return nil
+}
+
+// GoAway closes every local connection, first telling the clients that
+// understand it to reconnect elsewhere. Websockets are hijacked from the
+// http server, so shutting it down leaves them open.
+func (cm *clientMap) GoAway() {
+	for _, socket := range cm.localSockets(func(string) bool { return true }) {
+		if capabilitiesOf(socket).Has(wire.CapGoAway) {
+			if err := writeControl(socket, wire.Control{Kind: wire.ControlGoingAway, Reason: reasonGoingAway}); err != nil {
+				slog.Error("failed to send going away", slog.Any("error", err))
+			}
+		}
+		socket.WriteClose(CloseGoingAway, []byte(reasonGoingAway))
+		_ = socket.NetConn().Close()
+	}
+}
+
+// writeControl sends ctrl to the client of socket.
+func writeControl(socket *gws.Conn, ctrl wire.Control) error {
+	frame, err := wire.NewControlFrame(ctrl)
+	if err != nil {
+		return err
+	}
+	data, err := codecOf(socket).Encode(frame)
+	if err != nil {
+		return err
+	}
+	return socket.WriteMessage(gws.OpcodeBinary, data)
+}
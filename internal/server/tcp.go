@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/lxzan/gws"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is the range of public ports TCP tunnels are allocated from. The
+// zero value lets the operating system pick any free port.
+type portRange struct {
+	min, max int
+}
+
+// parsePortRange parses a range such as "20000-20100" or a single port.
+func parsePortRange(s string) (portRange, error) {
+	if s == "" {
+		return portRange{}, nil
+	}
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid tcp port range %q: %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid tcp port range %q: %w", s, err)
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return portRange{}, fmt.Errorf("invalid tcp port range %q", s)
+	}
+	return portRange{min: min, max: max}, nil
+}
+
+// listen opens a listener on the first free port of the range.
+func (r portRange) listen() (net.Listener, error) {
+	if r.min == 0 {
+		return net.Listen("tcp", ":0")
+	}
+	for port := r.min; port <= r.max; port++ {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, errors.New("no free tcp port left")
+}
+
+// openTCPListener allocates a public port for a TCP tunnel client, tells the
+// client about it and relays every accepted connection as a raw stream
+// published on the client's topic.
+func (c *Handler) openTCPListener(socket *gws.Conn, topic string) error {
+	ln, err := c.tcpPorts.listen()
+	if err != nil {
+		return err
+	}
+	socket.Session().Store("listener", ln)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	if err := writeControl(socket, wire.Control{Kind: wire.ControlTCPListener, Port: port}); err != nil {
+		return err
+	}
+	subdomain, _ := socket.Session().Load("subdomain")
+	slog.Info("tcp tunnel listening", slog.Any("subdomain", subdomain), slog.Int("port", port))
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("failed to accept tcp connection", slog.Any("error", err))
+				}
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				streamId := uuid.NewString()
+				slog.Debug("relaying tcp connection", slog.String("stream_id", streamId), slog.String("remote_addr", conn.RemoteAddr().String()))
+				if err := relayStream(c.pubSub, topic, streamId, nil, conn, conn); err != nil {
+					slog.Error("failed to relay tcp connection", slog.Any("error", err))
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// closeTCPListener stops accepting connections for socket's TCP tunnel.
+func closeTCPListener(socket *gws.Conn) {
+	if ln, ok := socket.Session().Load("listener"); ok {
+		_ = ln.(net.Listener).Close()
+	}
+}
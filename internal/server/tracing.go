@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/znowdev/reqbouncer/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/znowdev/reqbouncer/internal/server")
+
+// traceRequest runs forward in a span covering the public request of c,
+// continuing the trace of the caller if it sent one.
+func traceRequest(c echo.Context, subdomain string, forward func() error) (err error) {
+	req := c.Request()
+	ctx, span := tracer.Start(tracing.Extract(req.Context(), req.Header), "reqbouncer.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			attribute.String("reqbouncer.subdomain", subdomain),
+		))
+	c.SetRequest(req.WithContext(ctx))
+
+	defer func() {
+		var status int
+		if c.Response().Committed {
+			status = c.Response().Status
+		}
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			status = httpErr.Code
+		}
+		if r := recover(); r != nil {
+			tracing.End(span, status, errors.New("response aborted"))
+			panic(r)
+		}
+		tracing.End(span, status, err)
+	}()
+
+	return forward()
+}
@@ -0,0 +1,88 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// binaryVersion is the first byte of every binary frame. Version 1 frames
+// have no sequence number and are still accepted when decoding.
+const binaryVersion = 2
+
+// binaryHeaderSize is the fixed part of a binary frame:
+// version (1) + type (1) + seq (4) + id length (2) + payload length (4).
+const binaryHeaderSize = 1 + 1 + 4 + 2 + 4
+
+var (
+	ErrShortFrame         = errors.New("wire: short frame")
+	ErrUnsupportedVersion = errors.New("wire: unsupported frame version")
+)
+
+// MarshalBinary encodes w as a length-prefixed binary frame:
+//
+//	| version u8 | type u8 | seq u32 | id len u16 | id | payload len u32 | payload |
+func (w WireMessage) MarshalBinary() ([]byte, error) {
+	if len(w.ID) > math.MaxUint16 {
+		return nil, fmt.Errorf("wire: id too long (%d bytes)", len(w.ID))
+	}
+	if uint64(len(w.Payload)) > math.MaxUint32 {
+		return nil, fmt.Errorf("wire: payload too large (%d bytes)", len(w.Payload))
+	}
+
+	buf := make([]byte, binaryHeaderSize+len(w.ID)+len(w.Payload))
+	buf[0] = binaryVersion
+	buf[1] = byte(w.Type)
+	binary.BigEndian.PutUint32(buf[2:6], w.Seq)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(w.ID)))
+	n := 8 + copy(buf[8:], w.ID)
+	binary.BigEndian.PutUint32(buf[n:n+4], uint32(len(w.Payload)))
+	copy(buf[n+4:], w.Payload)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a frame produced by MarshalBinary. The payload is
+// copied, so data may be reused by the caller afterwards.
+func (w *WireMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrShortFrame
+	}
+
+	var seq uint32
+	rest := data[2:]
+	switch data[0] {
+	case 1:
+	case binaryVersion:
+		if len(rest) < 4 {
+			return ErrShortFrame
+		}
+		seq = binary.BigEndian.Uint32(rest[:4])
+		rest = rest[4:]
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, data[0])
+	}
+
+	if len(rest) < 2 {
+		return ErrShortFrame
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[:2]))
+	rest = rest[2:]
+	if len(rest) < idLen+4 {
+		return ErrShortFrame
+	}
+	id := string(rest[:idLen])
+	rest = rest[idLen:]
+	payloadLen := int(binary.BigEndian.Uint32(rest[:4]))
+	rest = rest[4:]
+	if len(rest) != payloadLen {
+		return ErrShortFrame
+	}
+
+	w.Type = FrameType(data[1])
+	w.Seq = seq
+	w.ID = id
+	w.Payload = make([]byte, payloadLen)
+	copy(w.Payload, rest)
+	return nil
+}
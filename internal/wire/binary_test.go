@@ -0,0 +1,96 @@
+package wire
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWireMessage_MarshalBinary(t *testing.T) {
+	w := WireMessage{
+		ID:      "testID",
+		Type:    FrameBody,
+		Seq:     3,
+		Payload: []byte("testPayload"),
+	}
+
+	got, err := w.MarshalBinary()
+	if err != nil {
+		t.Errorf("MarshalBinary() error = %v", err)
+		return
+	}
+
+	want := append([]byte{2, 2, 0, 0, 0, 3, 0, 6}, "testID"...)
+	want = append(want, 0, 0, 0, 11)
+	want = append(want, "testPayload"...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MarshalBinary() got = %v, want %v", got, want)
+	}
+}
+
+func TestWireMessage_UnmarshalBinary(t *testing.T) {
+	for _, codec := range []Codec{Binary, JSON} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			want := WireMessage{
+				ID:      "testID",
+				Type:    FrameBody,
+				Seq:     7,
+				Payload: []byte("testPayload"),
+			}
+			data, err := codec.Encode(want)
+			if err != nil {
+				t.Errorf("Encode() error = %v", err)
+				return
+			}
+
+			var got WireMessage
+			if err := codec.Decode(data, &got); err != nil {
+				t.Errorf("Decode() error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Decode() got = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWireMessage_UnmarshalBinaryVersion1(t *testing.T) {
+	data := append([]byte{1, 0, 0, 6}, "testID"...)
+	data = append(data, 0, 0, 0, 11)
+	data = append(data, "testPayload"...)
+
+	var got WireMessage
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Errorf("UnmarshalBinary() error = %v", err)
+		return
+	}
+
+	want := WireMessage{ID: "testID", Payload: []byte("testPayload")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UnmarshalBinary() got = %v, want %v", got, want)
+	}
+}
+
+func TestWireMessage_UnmarshalBinaryErrors(t *testing.T) {
+	valid, _ := WireMessage{ID: "id", Payload: []byte("payload")}.MarshalBinary()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrShortFrame},
+		{"truncated payload", valid[:len(valid)-1], ErrShortFrame},
+		{"trailing bytes", append(append([]byte{}, valid...), 0), ErrShortFrame},
+		{"unknown version", append([]byte{9}, valid[1:]...), ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w WireMessage
+			if err := w.UnmarshalBinary(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("UnmarshalBinary() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
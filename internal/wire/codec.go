@@ -0,0 +1,31 @@
+package wire
+
+// Codec encodes and decodes WireMessages for transport over the websocket.
+type Codec interface {
+	Name() string
+	Encode(WireMessage) ([]byte, error)
+	Decode([]byte, *WireMessage) error
+}
+
+var (
+	// Binary is the compact length-prefixed frame format.
+	Binary Codec = binaryCodec{}
+	// JSON is the original format, kept as a fallback for older peers.
+	JSON Codec = jsonCodec{}
+)
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Encode(w WireMessage) ([]byte, error) { return w.MarshalBinary() }
+
+func (binaryCodec) Decode(data []byte, w *WireMessage) error { return w.UnmarshalBinary(data) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(w WireMessage) ([]byte, error) { return w.Serialize() }
+
+func (jsonCodec) Decode(data []byte, w *WireMessage) error { return w.Deserialize(data) }
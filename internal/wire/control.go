@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// TunnelHeader is sent by the client during the handshake to choose what the
+// tunnel carries. A missing header means TunnelHTTP.
+const TunnelHeader = "reqbouncer-tunnel"
+
+const (
+	// TunnelHTTP forwards public HTTP requests for the client's subdomain.
+	TunnelHTTP = "http"
+	// TunnelTCP relays connections accepted on a public TCP port allocated
+	// by the server as raw streams.
+	TunnelTCP = "tcp"
+)
+
+// TunnelNameHeader is sent by a client registering a named tunnel. The
+// server serves it on the subdomain returned by NamedSubdomain, so a user
+// can run several tunnels at once.
+const TunnelNameHeader = "reqbouncer-tunnel-name"
+
+// namespaceSeparator joins a tunnel name with the login owning it. GitHub
+// logins cannot contain consecutive hyphens, so the owner is unambiguous.
+const namespaceSeparator = "--"
+
+var tunnelNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidTunnelName reports whether name can be used as the name of a tunnel.
+func ValidTunnelName(name string) bool {
+	return len(name) <= 32 && tunnelNamePattern.MatchString(name) && !strings.Contains(name, namespaceSeparator)
+}
+
+// NamedSubdomain returns the subdomain serving the tunnel name of login.
+func NamedSubdomain(name, login string) string {
+	return strings.ToLower(name + namespaceSeparator + login)
+}
+
+// OwnsSubdomain reports whether login may register a tunnel on subdomain:
+// either its own login or one of its named tunnels. The name has to be a
+// ValidTunnelName, so a login ending in another login does not own the
+// named tunnels of the latter.
+func OwnsSubdomain(login, subdomain string) bool {
+	login, subdomain = strings.ToLower(login), strings.ToLower(subdomain)
+	if subdomain == login {
+		return true
+	}
+	name, owner, ok := strings.Cut(subdomain, namespaceSeparator)
+	return ok && owner == login && ValidTunnelName(name)
+}
+
+// PoolHeader is sent by a client that wants to share its subdomain with
+// other clients asking for the same strategy. Without it the client claims
+// the subdomain exclusively.
+const PoolHeader = "reqbouncer-pool"
+
+const (
+	// PoolRoundRobin hands requests to the pool members in turn.
+	PoolRoundRobin = "round-robin"
+	// PoolLeastInflight hands requests to the member with the fewest
+	// unanswered requests.
+	PoolLeastInflight = "least-inflight"
+)
+
+// ValidPoolStrategy reports whether s names a known pool strategy.
+func ValidPoolStrategy(s string) bool {
+	return s == PoolRoundRobin || s == PoolLeastInflight
+}
+
+// OfflineQueueHeader is sent by a client that wants the server to accept
+// requests while it is disconnected and deliver them once it reconnects. The
+// value is the status code the queued requests are answered with.
+const OfflineQueueHeader = "reqbouncer-offline-queue"
+
+// ControlKind identifies a Control message.
+type ControlKind string
+
+const (
+	// ControlTCPListener tells a TCP tunnel client which public port the
+	// server is accepting connections on.
+	ControlTCPListener ControlKind = "tcp_listener"
+	// ControlGoingAway tells a client that the server is shutting down and
+	// it should reconnect, reaching another instance.
+	ControlGoingAway ControlKind = "going_away"
+)
+
+// Control is the payload of a FrameControl. Control messages are rare, so
+// they are always JSON regardless of the negotiated codec.
+type Control struct {
+	Kind ControlKind `json:"kind"`
+	Port int         `json:"port,omitempty"`
+	// Reason explains a ControlGoingAway.
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewControlFrame wraps ctrl in a FrameControl.
+func NewControlFrame(ctrl Control) (WireMessage, error) {
+	payload, err := json.Marshal(ctrl)
+	if err != nil {
+		return WireMessage{}, err
+	}
+	return WireMessage{Type: FrameControl, Payload: payload}, nil
+}
+
+// ParseControl decodes the payload of a FrameControl.
+func ParseControl(payload []byte) (Control, error) {
+	var ctrl Control
+	err := json.Unmarshal(payload, &ctrl)
+	return ctrl, err
+}
@@ -0,0 +1,59 @@
+package wire
+
+import "testing"
+
+func TestControlFrame(t *testing.T) {
+	frame, err := NewControlFrame(Control{Kind: ControlTCPListener, Port: 20001})
+	if err != nil {
+		t.Fatalf("NewControlFrame() error = %v", err)
+	}
+	if frame.Type != FrameControl {
+		t.Errorf("NewControlFrame() type = %v, want %v", frame.Type, FrameControl)
+	}
+
+	ctrl, err := ParseControl(frame.Payload)
+	if err != nil {
+		t.Fatalf("ParseControl() error = %v", err)
+	}
+	if ctrl.Kind != ControlTCPListener || ctrl.Port != 20001 {
+		t.Errorf("ParseControl() got = %+v", ctrl)
+	}
+}
+
+func TestValidTunnelName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"api":                               true,
+		"my-api-2":                          true,
+		"":                                  false,
+		"API":                               false,
+		"-api":                              false,
+		"api-":                              false,
+		"api--web":                          false,
+		"api.web":                           false,
+		"a23456789012345678901234567890123": false,
+	} {
+		if got := ValidTunnelName(name); got != want {
+			t.Errorf("ValidTunnelName(%q) got = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestOwnsSubdomain(t *testing.T) {
+	if got := NamedSubdomain("api", "Client1"); got != "api--client1" {
+		t.Errorf("NamedSubdomain() got = %v, want api--client1", got)
+	}
+	for subdomain, want := range map[string]bool{
+		"client1":         true,
+		"Client1":         true,
+		"api--client1":    true,
+		"api--client12":   false,
+		"x--api--client1": false,
+		"--client1":       false,
+		"apiclient1":      false,
+		"client2":         false,
+	} {
+		if got := OwnsSubdomain("client1", subdomain); got != want {
+			t.Errorf("OwnsSubdomain(client1, %q) got = %v, want %v", subdomain, got, want)
+		}
+	}
+}
@@ -2,8 +2,47 @@ package wire
 
 import "encoding/json"
 
+// FrameType identifies what a WireMessage carries.
+type FrameType uint8
+
+const (
+	// FrameHTTP carries a complete HTTP request or response dump.
+	FrameHTTP FrameType = iota
+	// FrameHead carries the head of a streamed HTTP request or response,
+	// i.e. everything up to and including the blank line before the body.
+	FrameHead
+	// FrameBody carries the next chunk of a streamed body.
+	FrameBody
+	// FrameEnd terminates a streamed body. A non-empty payload is an error
+	// message and means the body was aborted.
+	FrameEnd
+	// FrameOpen starts a raw byte stream, such as an upgraded WebSocket
+	// connection. Its payload is the HTTP request head to replay verbatim.
+	FrameOpen
+	// FrameData carries the next bytes of a raw stream.
+	FrameData
+	// FrameClose ends one direction of a raw stream. A non-empty payload is
+	// the reason the stream was closed.
+	FrameClose
+	// FrameCancel tells the client that the caller of request ID went away
+	// and the target request should be aborted. It is not sequenced.
+	FrameCancel
+	// FrameControl carries a Control message that is not tied to a request.
+	FrameControl
+)
+
+// IsFinal reports whether t is the last frame of its stream direction.
+func (t FrameType) IsFinal() bool {
+	return t == FrameEnd || t == FrameClose
+}
+
+// ChunkSize is the maximum body payload carried by a single FrameBody.
+const ChunkSize = 32 * 1024
+
 type WireMessage struct {
 	ID      string
+	Type    FrameType `json:",omitempty"`
+	Seq     uint32    `json:",omitempty"`
 	Payload []byte
 }
 
@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Handshake headers exchanged on the /_websocket upgrade. The client sends
+// its protocol version and capabilities, the server answers with its own and
+// both sides use the intersection for the lifetime of the connection.
+const (
+	VersionHeader      = "reqbouncer-protocol-version"
+	CapabilitiesHeader = "reqbouncer-capabilities"
+)
+
+// ClientVersionHeader carries the release of the client, so the server can
+// tell which builds are connected.
+const ClientVersionHeader = "reqbouncer-client-version"
+
+const (
+	// ProtocolVersion is the tunnel protocol version spoken by this build.
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest client protocol version a server
+	// accepts unless configured otherwise. Clients that predate the
+	// handshake report version 0.
+	MinProtocolVersion = 0
+	// MinServerProtocolVersion is the oldest server protocol version a
+	// client works with. Servers that predate the handshake report version
+	// 0 and cannot negotiate capabilities.
+	MinServerProtocolVersion = 1
+)
+
+// Capability is an optional protocol feature negotiated during the handshake.
+type Capability string
+
+const (
+	// CapBinary enables the binary frame codec instead of JSON.
+	CapBinary Capability = "binary"
+	// CapStreaming splits request and response bodies into FrameHead,
+	// FrameBody and FrameEnd frames instead of a single FrameHTTP.
+	CapStreaming Capability = "streaming"
+	// CapWebSocket relays upgraded WebSocket connections as raw streams of
+	// FrameOpen, FrameData and FrameClose frames.
+	CapWebSocket Capability = "websocket"
+	// CapCancel lets the server abort in-flight target requests with a
+	// FrameCancel when the public caller disconnects.
+	CapCancel Capability = "cancel"
+	// CapTCP allows TunnelTCP tunnels.
+	CapTCP Capability = "tcp"
+	// CapGoAway lets the server send a ControlGoingAway before it shuts
+	// down.
+	CapGoAway Capability = "goaway"
+)
+
+// SupportedCapabilities lists every capability this build implements.
+var SupportedCapabilities = Capabilities{CapBinary, CapStreaming, CapWebSocket, CapCancel, CapTCP, CapGoAway}
+
+// Capabilities is a set of negotiated protocol features.
+type Capabilities []Capability
+
+// ParseCapabilities parses a comma separated capabilities header value.
+func ParseCapabilities(s string) Capabilities {
+	var caps Capabilities
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			caps = append(caps, Capability(c))
+		}
+	}
+	return caps
+}
+
+// ParseVersion parses a protocol version header value. A missing header
+// means the peer predates the handshake and speaks version 0.
+func ParseVersion(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func (c Capabilities) Has(capability Capability) bool {
+	return slices.Contains(c, capability)
+}
+
+// Intersect returns the capabilities present in both c and other, in the
+// order of c.
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	var caps Capabilities
+	for _, capability := range c {
+		if other.Has(capability) {
+			caps = append(caps, capability)
+		}
+	}
+	return caps
+}
+
+// Codec returns the codec selected by the negotiated capabilities.
+func (c Capabilities) Codec() Codec {
+	if c.Has(CapBinary) {
+		return Binary
+	}
+	return JSON
+}
+
+func (c Capabilities) String() string {
+	s := make([]string, len(c))
+	for i, capability := range c {
+		s[i] = string(capability)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,42 @@
+package wire
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	got := ParseCapabilities(" binary, ,unknown")
+	want := Capabilities{CapBinary, "unknown"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCapabilities() got = %v, want %v", got, want)
+	}
+	if caps := ParseCapabilities(""); len(caps) != 0 {
+		t.Errorf("ParseCapabilities(\"\") got = %v, want none", caps)
+	}
+}
+
+func TestCapabilities_Intersect(t *testing.T) {
+	got := Capabilities{CapBinary}.Intersect(Capabilities{"unknown", CapBinary})
+	if !reflect.DeepEqual(got, Capabilities{CapBinary}) {
+		t.Errorf("Intersect() got = %v, want %v", got, Capabilities{CapBinary})
+	}
+	if got.Codec() != Binary {
+		t.Errorf("Codec() got = %v, want binary", got.Codec().Name())
+	}
+	if codec := SupportedCapabilities.Intersect(nil).Codec(); codec != JSON {
+		t.Errorf("Codec() for legacy peer got = %v, want json", codec.Name())
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	if v, err := ParseVersion(""); err != nil || v != 0 {
+		t.Errorf("ParseVersion(\"\") got = %v, %v, want 0", v, err)
+	}
+	if v, err := ParseVersion("1"); err != nil || v != 1 {
+		t.Errorf("ParseVersion(\"1\") got = %v, %v, want 1", v, err)
+	}
+	if _, err := ParseVersion("x"); err == nil {
+		t.Errorf("ParseVersion(\"x\") expected error")
+	}
+}
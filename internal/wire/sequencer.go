@@ -0,0 +1,54 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReorderWindow is how far ahead of the next deliverable frame a frame may
+// be. It bounds the frames a Sequencer holds back for a peer that never
+// sends the one they wait for.
+const ReorderWindow = 64
+
+// ErrReorderWindow is returned for frames too far ahead of the next one.
+var ErrReorderWindow = errors.New("wire: frame beyond reorder window")
+
+// Sequencer restores the order of the frames belonging to one request. Frames
+// may be delivered out of order by the pubsub, so every streamed frame
+// carries a Seq starting at 0.
+type Sequencer struct {
+	next    uint32
+	pending map[uint32]WireMessage
+}
+
+// Push adds w and returns the frames that are now deliverable, in order.
+// Frames that were already delivered are dropped. Frames more than
+// ReorderWindow ahead fail with ErrReorderWindow, after which the stream
+// should be aborted.
+func (s *Sequencer) Push(w WireMessage) ([]WireMessage, error) {
+	if w.Seq < s.next {
+		return nil, nil
+	}
+	if w.Seq > s.next {
+		if w.Seq-s.next > ReorderWindow {
+			return nil, fmt.Errorf("%w: got frame %d while waiting for %d", ErrReorderWindow, w.Seq, s.next)
+		}
+		if s.pending == nil {
+			s.pending = make(map[uint32]WireMessage)
+		}
+		s.pending[w.Seq] = w
+		return nil, nil
+	}
+
+	ready := []WireMessage{w}
+	s.next++
+	for {
+		next, ok := s.pending[s.next]
+		if !ok {
+			return ready, nil
+		}
+		delete(s.pending, s.next)
+		ready = append(ready, next)
+		s.next++
+	}
+}
@@ -0,0 +1,46 @@
+package wire
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSequencer_Push(t *testing.T) {
+	var s Sequencer
+	var got []uint32
+	for _, seq := range []uint32{2, 0, 3, 1, 1, 4} {
+		ready, err := s.Push(WireMessage{Seq: seq})
+		if err != nil {
+			t.Fatalf("Push(%d) error = %v", seq, err)
+		}
+		for _, w := range ready {
+			got = append(got, w.Seq)
+		}
+	}
+
+	want := []uint32{0, 1, 2, 3, 4}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Push() delivered %v, want %v", got, want)
+	}
+}
+
+func TestSequencer_PushBeyondWindow(t *testing.T) {
+	var s Sequencer
+	for seq := uint32(1); seq <= ReorderWindow; seq++ {
+		if _, err := s.Push(WireMessage{Seq: seq}); err != nil {
+			t.Fatalf("Push(%d) within the window error = %v", seq, err)
+		}
+	}
+	if _, err := s.Push(WireMessage{Seq: ReorderWindow + 1}); !errors.Is(err, ErrReorderWindow) {
+		t.Errorf("Push() beyond the window error = %v, want ErrReorderWindow", err)
+	}
+	if got := len(s.pending); got != ReorderWindow {
+		t.Errorf("Push() held back %d frames, want %d", got, ReorderWindow)
+	}
+
+	ready, err := s.Push(WireMessage{Seq: 0})
+	if err != nil || len(ready) != ReorderWindow+1 {
+		t.Errorf("Push(0) got %d frames, %v, want %d", len(ready), err, ReorderWindow+1)
+	}
+}
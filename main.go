@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mscno/zerrors"
+	"github.com/znowdev/reqbouncer/internal/authn"
 	"github.com/znowdev/reqbouncer/internal/client/auth"
 	"github.com/znowdev/reqbouncer/internal/config"
+	"github.com/znowdev/reqbouncer/internal/tracing"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime/debug"
@@ -64,56 +67,98 @@ func main() {
 			{
 				Name:  "login",
 				Usage: "logs in to the reqbouncer server",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "encrypt",
+						Usage: "encrypt the stored credentials with the passphrase in " + auth.PassphraseEnv,
+					},
+				},
 				Action: func(cCtx *cli.Context) error {
+					passphrase := ""
+					if cCtx.Bool("encrypt") {
+						if passphrase = os.Getenv(auth.PassphraseEnv); passphrase == "" {
+							return fmt.Errorf("set %s to the passphrase to encrypt the credentials with", auth.PassphraseEnv)
+						}
+					}
 
-					// Trim newline characters
-
-					// Get user home directory
-					homeDir, err := os.UserHomeDir()
+					githubClientId, err := auth.GetGithubConfig(defaultServer)
 					if err != nil {
 						return err
 					}
 
-					// Create .reqbouncer directory if it doesn't exist
-					reqBouncerDir := filepath.Join(homeDir, ".reqbouncer")
-					if _, err := os.Stat(reqBouncerDir); os.IsNotExist(err) {
-						err = os.Mkdir(reqBouncerDir, 0755)
-						if err != nil {
-							return err
-						}
+					token, err := auth.Login(cCtx.Context, githubClientId)
+					if err != nil {
+						return err
 					}
 
-					githubClientId, err := auth.GetGithubConfig(defaultServer)
+					// Only the session the GitHub token is exchanged for is
+					// kept.
+					session, err := auth.StartSession(defaultServer, token.AccessToken)
 					if err != nil {
 						return err
 					}
+					serverHost := fmt.Sprintf("%s.%s", session.Login, defaultServer)
 
-					token, err := auth.Login(cCtx.Context, githubClientId)
-					if err != nil {
+					if err := setConfigKey("server_host", serverHost); err != nil {
+						return err
+					}
+					// Drop the plain text token of earlier versions.
+					if err := setConfigKey("access_token"); err != nil {
 						return err
 					}
 
-					githubUser, err := auth.GetGitHubUser(token.AccessToken)
+					helper, err := parseConfigKey("credential_helper")
 					if err != nil {
 						return err
 					}
-					serverHost := fmt.Sprintf("%s.%s", githubUser.Login, defaultServer)
+					if helper != "" {
+						fmt.Printf("Login successful, session valid until %s.\n", session.ExpiresAt.Local().Format(time.DateTime))
+						fmt.Printf("Store the access token below where your credential helper `%s` reads it from:\n%s\n", helper, session.Token)
+						return nil
+					}
 
-					// Create config file
-					configFile := filepath.Join(reqBouncerDir, "config")
-					file, err := os.Create(configFile)
+					path, err := credentialsPath()
 					if err != nil {
 						return err
 					}
-					defer file.Close()
+					if err := auth.SaveCredentials(path, auth.Credentials{AccessToken: session.Token}, passphrase); err != nil {
+						return err
+					}
 
-					// Write server host and secret token to config file
-					_, err = file.WriteString(fmt.Sprintf("server_host=%s\naccess_token=%s", serverHost, token.AccessToken))
+					fmt.Printf("Login successful, session valid until %s.\n", session.ExpiresAt.Local().Format(time.DateTime))
+					return nil
+				},
+			},
+			{
+				Name:  "logout",
+				Usage: "ends the session of the last login",
+				Action: func(cCtx *cli.Context) error {
+					token, err := loadToken(cCtx)
 					if err != nil {
 						return err
 					}
+					if token == "" {
+						return fmt.Errorf("not logged in")
+					}
+					if err := auth.EndSession(defaultServer, token); err != nil {
+						return err
+					}
 
-					fmt.Println("Login successful.")
+					path, err := credentialsPath()
+					if err != nil {
+						return err
+					}
+					if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+					if err := setConfigKey("access_token"); err != nil {
+						return err
+					}
+					if helper, _ := parseConfigKey("credential_helper"); helper != "" {
+						fmt.Printf("Logout successful, remove the access token from where your credential helper `%s` reads it.\n", helper)
+						return nil
+					}
+					fmt.Println("Logout successful.")
 					return nil
 				},
 			},
@@ -145,9 +190,45 @@ func main() {
 
 					return server.Start(logger, server.Config{
 						GithubClientid:     cfg.GithubClientId,
-						GithubUserProvider: auth.GetGitHubUser,
-						CiTestToken:        os.Getenv(ciTestTokenEnvKey),
-						Port:               port,
+						GithubUserProvider: auth.NewGitHubUserProvider(cfg.GitHubAPIURL),
+						Auth: authn.Config{
+							Provider:  cfg.AuthProvider,
+							TokenFile: cfg.AuthTokenFile,
+							GitHub: authn.GitHubAccess{
+								APIURL: cfg.GitHubAPIURL,
+								Orgs:   cfg.GitHubOrgs,
+								Teams:  cfg.GitHubTeams,
+							},
+							OIDC: authn.OIDCConfig{
+								Issuer:       cfg.OIDCIssuer,
+								ClientID:     cfg.OIDCClientID,
+								ClientSecret: cfg.OIDCClientSecret,
+								LoginClaim:   cfg.OIDCLoginClaim,
+							},
+							GitLabURL:        cfg.GitLabURL,
+							CacheTTL:         cfg.AuthCacheTTL,
+							NegativeCacheTTL: cfg.AuthNegativeTTL,
+						},
+						CiTestToken:      os.Getenv(ciTestTokenEnvKey),
+						Port:             port,
+						TCPPortRange:     cfg.TCPPortRange,
+						InspectHistory:   cfg.InspectHistory,
+						OfflineQueueTTL:  cfg.OfflineQueueTTL,
+						OfflineQueueSize: cfg.OfflineQueueSize,
+						PubSub:           cfg.PubSub,
+						PubSubURL:        cfg.PubSubURL,
+						AdminLogins:      cfg.AdminLogins,
+						BlockedLogins:    cfg.BlockedLogins,
+						MetricsAddr:      cfg.MetricsAddr,
+						Tracing: tracing.Config{
+							Exporter: cfg.TracingExporter,
+							Endpoint: cfg.TracingEndpoint,
+						},
+						ShutdownTimeout:    cfg.ShutdownTimeout,
+						MinProtocolVersion: cfg.MinProtocolVersion,
+						SessionSecret:      cfg.SessionSecret,
+						SessionTTL:         cfg.SessionTTL,
+						SessionRecheck:     cfg.SessionRecheck,
 						Debug:              cCtx.Bool("debug"),
 					})
 				},
@@ -161,6 +242,47 @@ func main() {
 						Aliases: []string{"s"},
 						Usage:   "reqbouncer server to connect to",
 					},
+					&cli.BoolFlag{
+						Name:  "tcp",
+						Usage: "forward raw tcp connections instead of http requests",
+					},
+					&cli.StringFlag{
+						Name:    "name",
+						Aliases: []string{"n"},
+						Usage:   "register a named tunnel, so several tunnels can run at once",
+					},
+					&cli.StringSliceFlag{
+						Name:  "route",
+						Usage: "forward requests by path prefix to another target, e.g. /api=localhost:8080 (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "inspect",
+						Usage: "serve a local web inspector of the forwarded requests on the given address, e.g. :4040 (bound to 127.0.0.1 unless a host is given)",
+					},
+					&cli.StringFlag{
+						Name:  "metrics",
+						Usage: "serve prometheus metrics of the client on the given address, e.g. :9091",
+					},
+					&cli.StringFlag{
+						Name:  "tracing",
+						Usage: "export traces of the forwarded requests with otlp or stdout",
+					},
+					&cli.StringFlag{
+						Name:  "tracing-endpoint",
+						Usage: "host:port of the collector receiving otlp traces over http, e.g. localhost:4318",
+					},
+					&cli.BoolFlag{
+						Name:  "record",
+						Usage: "store forwarded requests in ~/.reqbouncer/requests so they can be replayed, with credential headers redacted",
+					},
+					&cli.IntFlag{
+						Name:  "offline-queue",
+						Usage: "have the server answer requests with this status code, e.g. 202, while disconnected and deliver them on reconnect",
+					},
+					&cli.StringFlag{
+						Name:  "pool",
+						Usage: "share the subdomain with other clients, distributing requests round-robin or least-inflight",
+					},
 				},
 				Action: func(cCtx *cli.Context) error {
 					if cCtx.NArg() == 0 {
@@ -175,11 +297,34 @@ func main() {
 						// If arg is an integer, forward to localhost:port
 						target = "localhost:" + arg
 					}
+					routes, err := parseRoutes(cCtx)
+					if err != nil {
+						return err
+					}
+					var dumpDir string
+					if cCtx.Bool("record") {
+						if dumpDir, err = requestsDir(); err != nil {
+							return err
+						}
+					}
 					c, err := client.NewClient(client.Config{
-						Target:      target,
-						Server:      parseServer(cCtx),
-						Path:        "/_websocket",
-						AccessToken: parseToken(cCtx),
+						Target:       target,
+						Server:       parseServer(cCtx),
+						Path:         "/_websocket",
+						AccessToken:  parseToken(cCtx),
+						TCP:          cCtx.Bool("tcp"),
+						Pool:         cCtx.String("pool"),
+						Name:         cCtx.String("name"),
+						Routes:       routes,
+						Inspect:      cCtx.String("inspect"),
+						Metrics:      cCtx.String("metrics"),
+						DumpDir:      dumpDir,
+						OfflineQueue: cCtx.Int("offline-queue"),
+						Version:      version(),
+						Tracing: tracing.Config{
+							Exporter: cCtx.String("tracing"),
+							Endpoint: cCtx.String("tracing-endpoint"),
+						},
 					})
 					if err != nil {
 						return err
@@ -187,6 +332,65 @@ func main() {
 					return c.Listen(cCtx.Context)
 				},
 			},
+			{
+				Name:      "replay",
+				Usage:     "replays a request stored by the forwarding client and shows how the response changed",
+				ArgsUsage: "[request-id]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "target",
+						Aliases: []string{"t"},
+						Usage:   "port or address to replay to instead of the original target",
+					},
+					&cli.StringSliceFlag{
+						Name:    "header",
+						Aliases: []string{"H"},
+						Usage:   "replace a request header, e.g. \"X-Signature: abc\", an empty value removes it (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "body",
+						Usage: "replace the request body",
+					},
+					&cli.StringFlag{
+						Name:  "body-file",
+						Usage: "replace the request body with the content of a file",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					dir, err := requestsDir()
+					if err != nil {
+						return err
+					}
+					store := client.NewDumpStore(dir, client.DefaultDumpRetention)
+
+					if cCtx.NArg() == 0 {
+						return listDumps(store)
+					}
+
+					dump, err := store.Load(cCtx.Args().Get(0))
+					if err != nil {
+						return err
+					}
+
+					opts, err := parseReplayOptions(cCtx)
+					if err != nil {
+						return err
+					}
+					resp, diff, err := client.Replay(dump, opts)
+					if err != nil {
+						return err
+					}
+
+					status, _, _ := strings.Cut(string(resp), "\r\n")
+					fmt.Println(status)
+					if diff == "" {
+						fmt.Println("response is identical to the original")
+					} else {
+						fmt.Print(diff)
+					}
+					return nil
+				},
+			},
 		},
 	}
 
@@ -198,10 +402,20 @@ func main() {
 }
 
 func parseConfigKey(key string) (string, error) {
+	values, err := parseConfigKeys(key)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// parseConfigKeys returns every value of a key that may be repeated in the
+// config file.
+func parseConfigKeys(key string) ([]string, error) {
 	// Get user home directory
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Open config file
@@ -209,41 +423,148 @@ func parseConfigKey(key string) (string, error) {
 	file, err := os.Open(configFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return "", nil
+			return nil, nil
 		}
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
 	// Read config file
+	var values []string
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, key+"=") {
+		if value, ok := configValue(scanner.Text(), key); ok {
 			slog.Debug(fmt.Sprintf("found key `%s` in config file", key))
-			return strings.TrimSpace(strings.TrimPrefix(line, key+"=")), nil
+			values = append(values, value)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// configValue returns the value of line if it sets key. Both key=value and
+// key = "value" are accepted.
+func configValue(line, key string) (string, bool) {
+	k, value, ok := strings.Cut(line, "=")
+	if !ok || strings.TrimSpace(k) != key {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	return value, true
+}
+
+// setConfigKey replaces the lines of key in the config file with one per
+// value, so without values key is removed.
+func setConfigKey(key string, values ...string) error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	reqBouncerDir := filepath.Join(homeDir, ".reqbouncer")
+	if err := os.MkdirAll(reqBouncerDir, 0755); err != nil {
+		return err
+	}
+	configFile := filepath.Join(reqBouncerDir, "config")
+	content, err := os.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if _, ok := configValue(line, key); !ok && line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for _, value := range values {
+		lines = append(lines, key+"="+value)
+	}
+	return os.WriteFile(configFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// credentialsPath is where the access token is stored, apart from the
+// config so the latter can be shared.
+func credentialsPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
 		return "", err
 	}
+	return filepath.Join(homeDir, ".reqbouncer", "credentials"), nil
+}
+
+// parseRoutes reads the routing table from the --route flags, falling back
+// to the route lines of the config file.
+func parseRoutes(cCtx *cli.Context) ([]client.Route, error) {
+	values := cCtx.StringSlice("route")
+	if len(values) == 0 {
+		var err error
+		values, err = parseConfigKeys("route")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return "", nil
+	routes := make([]client.Route, 0, len(values))
+	for _, v := range values {
+		route, err := client.ParseRoute(v)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
 }
 
 func parseToken(cCtx *cli.Context) string {
-	token := cCtx.String("access-token")
-	if token != "" {
-		return token
+	token, err := loadToken(cCtx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return token
+}
+
+// loadToken returns the access token of the --access-token flag, else the
+// one printed by the configured credential helper, else the one in the
+// credentials file.
+func loadToken(cCtx *cli.Context) (string, error) {
+	if token := cCtx.String("access-token"); token != "" {
+		return token, nil
 	}
 
-	token, err := parseConfigKey("access_token")
+	helper, err := parseConfigKey("credential_helper")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if helper != "" {
+		creds, err := auth.CredentialsFromHelper(cCtx.Context, helper)
+		return creds.AccessToken, err
 	}
 
-	return token
+	path, err := credentialsPath()
+	if err != nil {
+		return "", err
+	}
+	creds, err := auth.LoadCredentials(path, os.Getenv(auth.PassphraseEnv))
+	if err != nil {
+		return "", err
+	}
+	if creds.AccessToken != "" {
+		return creds.AccessToken, nil
+	}
+
+	// Versions before the credentials file kept the token in the config.
+	token, err := parseConfigKey("access_token")
+	if token != "" {
+		slog.Warn("access token stored in plain text in the config, run reqbouncer login again to move it")
+	}
+	return token, err
 }
 
 func parseServer(cCtx *cli.Context) string {
@@ -260,6 +581,61 @@ func parseServer(cCtx *cli.Context) string {
 	return server
 }
 
+// requestsDir is where the forwarding client stores requests for replaying
+// them.
+func requestsDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".reqbouncer", "requests"), nil
+}
+
+func listDumps(store *client.DumpStore) error {
+	dumps, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(dumps) == 0 {
+		fmt.Println("no stored requests, forward some with reqbouncer forward first")
+		return nil
+	}
+	for _, d := range dumps {
+		requestLine, _, _ := strings.Cut(string(d.Request), "\r\n")
+		fmt.Printf("%s  %s  %s\n", d.ID, d.Time.Format(time.DateTime), requestLine)
+	}
+	return nil
+}
+
+func parseReplayOptions(cCtx *cli.Context) (client.ReplayOptions, error) {
+	opts := client.ReplayOptions{Target: cCtx.String("target"), Header: http.Header{}}
+	if _, err := strconv.Atoi(opts.Target); err == nil {
+		opts.Target = "localhost:" + opts.Target
+	}
+
+	for _, h := range cCtx.StringSlice("header") {
+		name, value, found := strings.Cut(h, ":")
+		if !found {
+			return client.ReplayOptions{}, fmt.Errorf("invalid header %q, expected \"Name: value\"", h)
+		}
+		opts.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	switch {
+	case cCtx.IsSet("body") && cCtx.IsSet("body-file"):
+		return client.ReplayOptions{}, errors.New("use either --body or --body-file")
+	case cCtx.IsSet("body"):
+		opts.Body = []byte(cCtx.String("body"))
+	case cCtx.IsSet("body-file"):
+		body, err := os.ReadFile(cCtx.String("body-file"))
+		if err != nil {
+			return client.ReplayOptions{}, err
+		}
+		opts.Body = body
+	}
+	return opts, nil
+}
+
 func version() string {
 	if Version == "" {
 		i, ok := debug.ReadBuildInfo()
@@ -1,82 +1,83 @@
 package tests
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lxzan/gws"
+	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/stretchr/testify/require"
+	"github.com/znowdev/reqbouncer/internal/authn"
 	"github.com/znowdev/reqbouncer/internal/client"
 	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"github.com/znowdev/reqbouncer/internal/inspect"
+	"github.com/znowdev/reqbouncer/internal/pubsub"
 	"github.com/znowdev/reqbouncer/internal/server"
 	"github.com/znowdev/reqbouncer/internal/slogger"
+	"github.com/znowdev/reqbouncer/internal/wire"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestE2E(t *testing.T) {
-	slogger.NewSlogger(true)
-	targetPort := "50000"
-	serverPort := "50001"
-	logger, _ := slogger.NewSlogger(true)
-	go func() {
-		// Start server
-		err := server.Start(logger, server.Config{
-			GithubUserProvider: func(token string) (auth.GitHubUser, error) {
-				return auth.GitHubUser{
-					Login: "client1",
-				}, nil
-			},
-			Port: serverPort,
-		})
-		if err != nil {
-			t.Fatalf("failed to start server: %v", err)
-		}
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-	// Start client
-
-	go func() {
-		// Start client
-		client, err := client.NewClient(client.Config{
-			Target:      "localhost:" + targetPort,
-			Server:      "localhost:" + serverPort,
-			Path:        "/_websocket",
-			AccessToken: "secret",
-		})
-		if err != nil {
-			t.Fatalf("failed to start client: %v", err)
-		}
-		err = client.Listen(context.Background())
-		if err != nil {
-			t.Fatalf("failed to listen: %v", err)
-
-		}
-	}()
-
-	go func() {
-		// Start target
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			slog.Debug("received request in target")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Hello, world!"))
-		})
-		mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
-			slog.Debug("received echo request in target")
-			w.WriteHeader(http.StatusOK)
-			io.Copy(w, r.Body)
-		})
-		err := http.ListenAndServe(":"+targetPort, mux)
+	releaseEvent := make(chan struct{})
+	slowCancelled := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received slow request in target")
+		<-r.Context().Done()
+		close(slowCancelled)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received websocket request in target")
+		socket, err := gws.NewUpgrader(&wsEchoHandler{}, nil).Upgrade(w, r)
 		if err != nil {
-			t.Fatalf("failed to start target: %v", err)
+			return
 		}
-	}()
-
-	time.Sleep(100 * time.Millisecond)
+		socket.ReadLoop()
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received events request in target")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-releaseEvent
+		w.Write([]byte("data: second\n\n"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received request in target")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Hello, world!"))
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received echo request in target")
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/ignore", func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("received ignore request in target")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ignored"))
+	})
+	target := startTarget(t, mux)
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	startClient(t, serverPort, client.Config{Target: target})
 
 	// E2ETest
 	t.Run("Server health check", func(t *testing.T) {
@@ -127,6 +128,100 @@ func TestE2E(t *testing.T) {
 		}
 	})
 
+	t.Run("Target POST larger than a single frame", func(t *testing.T) {
+		payload := strings.Repeat("0123456789abcdef", 256*1024) // 4 MiB
+		resp, err := http.Post("http://localhost:"+serverPort+"/echo", "text/plain", strings.NewReader(payload))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, len(payload), len(body))
+		require.Equal(t, payload, string(body))
+	})
+
+	t.Run("Target answering a large POST without reading it", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			// The caller is still sending the body when the response
+			// arrives.
+			body, bodyWriter := io.Pipe()
+			go func() {
+				chunk := []byte(strings.Repeat("0123456789abcdef", 4*1024)) // 64 KiB
+				for i := 0; i < 64; i++ {
+					if _, err := bodyWriter.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				bodyWriter.Close()
+			}()
+			resp, err := http.Post("http://localhost:"+serverPort+"/ignore", "text/plain", body)
+			require.NoError(t, err)
+			got, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "ignored", string(got))
+		}
+	})
+
+	t.Run("Target event stream", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:" + serverPort + "/events")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// The first event must arrive while the target is still holding
+		// the response open.
+		reader := bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "data: first\n", line)
+
+		close(releaseEvent)
+		rest, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "\ndata: second\n\n", string(rest))
+	})
+
+	t.Run("Target websocket", func(t *testing.T) {
+		received := make(chan string, 1)
+		socket, resp, err := gws.NewClient(&wsRecorder{received: received}, &gws.ClientOption{
+			Addr: "ws://localhost:" + serverPort + "/ws",
+		})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		defer socket.NetConn().Close()
+		go socket.ReadLoop()
+
+		for _, want := range []string{"hello", strings.Repeat("x", 100_000)} {
+			require.NoError(t, socket.WriteString(want))
+			select {
+			case got := <-received:
+				require.Equal(t, want, got)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for websocket echo")
+			}
+		}
+	})
+
+	t.Run("Target request cancelled by caller", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost:"+serverPort+"/slow", nil)
+		require.NoError(t, err)
+		_, err = http.DefaultClient.Do(req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		select {
+		case <-slowCancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("target request was not cancelled")
+		}
+	})
+
 	t.Run("Target GET with client id", func(t *testing.T) {
 		req, err := http.NewRequest("GET", "http://localhost:"+serverPort+"/", nil)
 		if err != nil {
@@ -134,6 +229,9 @@ func TestE2E(t *testing.T) {
 		}
 		req.Header.Set("reqbouncer-client-id", "client1")
 		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
 		if resp.StatusCode != http.StatusOK {
 			body, _ := io.ReadAll(resp.Body)
 			t.Fatalf("expected status code %d, got %d (%s)", http.StatusOK, resp.StatusCode, body)
@@ -151,106 +249,942 @@ func TestE2E(t *testing.T) {
 }
 
 func TestE2EMultiClientsWithSameId(t *testing.T) {
-	logger, _ := slogger.NewSlogger(true)
+	// Nothing listens on the target, the clients never get to forward.
+	target := "localhost:" + freePort(t)
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	startClient(t, serverPort, client.Config{Target: target})
 
-	targetPort := "50002"
-	serverPort := "50003"
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	err := newClient(t, serverPort, client.Config{Target: target}).Listen(ctx)
+	require.Error(t, err)
+}
 
-	go func() {
-		// Start server
-		err := server.Start(logger, server.Config{
-			GithubUserProvider: func(token string) (auth.GitHubUser, error) {
-				return auth.GitHubUser{
-					Login: "client1",
-				}, nil
-			},
-			Port: serverPort,
-		})
+func TestE2EOutdatedServer(t *testing.T) {
+	// A server predating the handshake upgrades without telling its
+	// protocol version.
+	outdated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := gws.NewUpgrader(&gws.BuiltinEventHandler{}, nil).Upgrade(w, r)
 		if err != nil {
-			t.Fatalf("failed to start server: %v", err)
+			return
 		}
-	}()
+		socket.ReadLoop()
+	}))
+	t.Cleanup(outdated.Close)
+	_, port, err := net.SplitHostPort(outdated.Listener.Addr().String())
+	require.NoError(t, err)
 
-	time.Sleep(100 * time.Millisecond)
-	// Start client
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = newClient(t, port, client.Config{Target: "localhost:" + freePort(t)}).Listen(ctx)
+	require.ErrorContains(t, err, "please upgrade the server")
+}
 
+func TestE2ETCPTunnel(t *testing.T) {
+	// Start a tcp echo target
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
 	go func() {
-		// Start client
-		client, err := client.NewClient(client.Config{
-			Target:      "localhost:" + targetPort,
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tunnelPort := freePort(t)
+	serverPort := startServer(t, server.Config{
+		GithubUserProvider: githubLogin("client1"),
+		TCPPortRange:       tunnelPort,
+	})
+	startClient(t, serverPort, client.Config{Target: ln.Addr().String(), TCP: true})
+
+	t.Run("Echo over tunnel", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:"+tunnelPort)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		reader := bufio.NewReader(conn)
+		for _, want := range []string{"hello\n", strings.Repeat("x", 100_000) + "\n"} {
+			_, err := conn.Write([]byte(want))
+			require.NoError(t, err)
+			got, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		}
+	})
+
+	t.Run("HTTP requests are rejected", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:" + serverPort + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+}
+
+func TestE2EPool(t *testing.T) {
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+
+	var targets []string
+	for _, name := range []string{"first", "second"} {
+		// Start a target answering with its name and a pooled client for it
+		target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		startClient(t, serverPort, client.Config{Target: target, Pool: wire.PoolRoundRobin})
+		targets = append(targets, target)
+	}
+
+	t.Run("Requests are distributed round-robin", func(t *testing.T) {
+		seen := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			resp, err := http.Get("http://localhost:" + serverPort + "/")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			seen[string(body)]++
+		}
+		require.Equal(t, map[string]int{"first": 2, "second": 2}, seen)
+	})
+
+	t.Run("Exclusive client is rejected", func(t *testing.T) {
+		c := newClient(t, serverPort, client.Config{Target: targets[0]})
+		require.Error(t, c.Listen(context.Background()))
+	})
+
+	t.Run("Client with another strategy is rejected", func(t *testing.T) {
+		c := newClient(t, serverPort, client.Config{Target: targets[0], Pool: wire.PoolLeastInflight})
+		require.ErrorContains(t, c.Listen(context.Background()), "different strategy")
+	})
+}
+
+func TestE2ENamedTunnels(t *testing.T) {
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+
+	names := []string{"api", "web"}
+	for _, name := range names {
+		// Start a target answering with the tunnel name and a named client
+		// for it
+		target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		startClient(t, serverPort, client.Config{Target: target, Name: name})
+	}
+
+	for _, name := range names {
+		t.Run("Target GET via "+name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://localhost:"+serverPort+"/", nil)
+			require.NoError(t, err)
+			req.Host = name + "--client1.localhost"
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, name, string(body))
+		})
+	}
+
+	t.Run("Invalid name is rejected", func(t *testing.T) {
+		_, err := client.NewClient(client.Config{
+			Target:      "localhost:" + serverPort,
 			Server:      "localhost:" + serverPort,
 			Path:        "/_websocket",
 			AccessToken: "secret",
+			Name:        "Not a name",
 		})
-		if err != nil {
-			t.Fatalf("failed to start client: %v", err)
+		require.Error(t, err)
+	})
+}
+
+func TestE2ERoutes(t *testing.T) {
+	// Start a target per route answering with its name and the request path
+	targets := make(map[string]string)
+	for _, name := range []string{"default", "api"} {
+		targets[name] = startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	route, err := client.ParseRoute("/api=" + targets["api"])
+	require.NoError(t, err)
+	startClient(t, serverPort, client.Config{Target: targets["default"], Routes: []client.Route{route}})
+
+	for path, want := range map[string]string{
+		"/":          "default /",
+		"/api":       "api /api",
+		"/api/users": "api /api/users",
+		"/apis":      "default /apis",
+	} {
+		t.Run("Target GET "+path, func(t *testing.T) {
+			resp, err := http.Get("http://localhost:" + serverPort + path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, want, string(body))
+		})
+	}
+}
+
+func TestE2EInspection(t *testing.T) {
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Target", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.Copy(w, r.Body)
+	}))
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	startClient(t, serverPort, client.Config{Target: target, Name: "hooks"})
+	subdomain := "hooks--client1"
+
+	listRequests := func(t *testing.T, subdomain, token string) *http.Response {
+		req, err := http.NewRequest("GET", "http://localhost:"+serverPort+"/_api/tunnels/"+subdomain+"/requests", nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
 		}
-		err = client.Listen(context.Background())
-		if err != nil {
-			t.Fatalf("failed to listen: %v", err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
 
+	t.Run("Forwarded request is recorded", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://localhost:"+serverPort+"/hook?source=test", strings.NewReader(`{"event":"push"}`))
+		require.NoError(t, err)
+		req.Host = subdomain + ".localhost"
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = listRequests(t, subdomain, "secret")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var history struct {
+			Requests []inspect.Exchange `json:"requests"`
 		}
-	}()
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+		require.Len(t, history.Requests, 1)
+		ex := history.Requests[0]
+		require.Equal(t, "POST", ex.Method)
+		require.Equal(t, "/hook?source=test", ex.Path)
+		require.Equal(t, "application/json", ex.RequestHeader.Get("Content-Type"))
+		require.Equal(t, `{"event":"push"}`, string(ex.RequestBody))
+		require.Equal(t, http.StatusCreated, ex.Status)
+		require.Equal(t, "yes", ex.ResponseHeader.Get("X-Target"))
+		require.Equal(t, `{"event":"push"}`, string(ex.ResponseBody))
+	})
+
+	t.Run("History requires a token", func(t *testing.T) {
+		resp := listRequests(t, subdomain, "")
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("History of another user is forbidden", func(t *testing.T) {
+		resp := listRequests(t, "client2", "secret")
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("History of a localhost host is forbidden", func(t *testing.T) {
+		resp := listRequests(t, "localhost:"+serverPort, "secret")
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestE2EClientInspector(t *testing.T) {
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("thanks"))
+	}))
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	// Without a host the inspector only listens on the loopback interface.
+	inspectorPort := freePort(t)
+	inspectorAddr := "127.0.0.1:" + inspectorPort
+	startClient(t, serverPort, client.Config{Target: target, Inspect: ":" + inspectorPort})
+
+	t.Run("Inspector page", func(t *testing.T) {
+		resp, err := http.Get("http://" + inspectorAddr + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	})
+
+	t.Run("Forwarded request shows up live", func(t *testing.T) {
+		events, err := http.Get("http://" + inspectorAddr + "/api/events")
+		require.NoError(t, err)
+		defer events.Body.Close()
+
+		resp, err := http.Post("http://localhost:"+serverPort+"/webhook", "text/plain", strings.NewReader("ping"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		line, err := bufio.NewReader(events.Body).ReadString('\n')
+		require.NoError(t, err)
+		var ex inspect.Exchange
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ex))
+		require.Equal(t, "POST", ex.Method)
+		require.Equal(t, "/webhook", ex.Path)
+		require.Equal(t, "ping", string(ex.RequestBody))
+		require.Equal(t, http.StatusAccepted, ex.Status)
+		require.Equal(t, "thanks", string(ex.ResponseBody))
+
+		list, err := http.Get("http://" + inspectorAddr + "/api/requests")
+		require.NoError(t, err)
+		defer list.Body.Close()
+		var history struct {
+			Requests []inspect.Exchange `json:"requests"`
+		}
+		require.NoError(t, json.NewDecoder(list.Body).Decode(&history))
+		require.Len(t, history.Requests, 1)
+		require.Equal(t, ex.ID, history.Requests[0].ID)
+	})
+}
+
+func TestE2EReplay(t *testing.T) {
+	// Start a target whose answer changes on every call
+	var calls atomic.Int32
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "call %d: %s %s", calls.Add(1), r.Header.Get("X-Event"), body)
+	}))
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	dumpDir := t.TempDir()
+	startClient(t, serverPort, client.Config{Target: target, DumpDir: dumpDir})
 
+	req, err := http.NewRequest("POST", "http://localhost:"+serverPort+"/webhook", strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set("X-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", "sha256=abc")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	store := client.NewDumpStore(dumpDir, client.DefaultDumpRetention)
+	var dumps []client.Dump
+	require.Eventually(t, func() bool {
+		dumps, err = store.List()
+		return err == nil && len(dumps) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Contains(t, string(dumps[0].Request), "POST /webhook HTTP/1.1")
+	require.Contains(t, string(dumps[0].Response), "call 1: push payload")
+
+	t.Run("Credentials are redacted", func(t *testing.T) {
+		require.Contains(t, string(dumps[0].Request), "X-Hub-Signature-256: [redacted]")
+		require.NotContains(t, string(dumps[0].Request), "sha256=abc")
+	})
+
+	t.Run("Replay shows the changed response", func(t *testing.T) {
+		resp, diff, err := client.Replay(dumps[0], client.ReplayOptions{})
+		require.NoError(t, err)
+		require.Contains(t, string(resp), "call 2: push payload")
+		require.Contains(t, diff, "-call 1: push payload")
+		require.Contains(t, diff, "+call 2: push payload")
+	})
+
+	t.Run("Replay with edited request", func(t *testing.T) {
+		resp, _, err := client.Replay(dumps[0], client.ReplayOptions{
+			Header: http.Header{"X-Event": {"release"}},
+			Body:   []byte("edited"),
+		})
+		require.NoError(t, err)
+		require.Contains(t, string(resp), "call 3: release edited")
+	})
+}
+
+func TestE2EOfflineQueue(t *testing.T) {
+	received := make(chan string, 10)
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+
+	// Connect a client opting into offline queueing, then drop it.
+	socket, _, err := gws.NewClient(&gws.BuiltinEventHandler{}, &gws.ClientOption{
+		Addr: "ws://localhost:" + serverPort + "/_websocket",
+		RequestHeader: http.Header{
+			"Authorization":         {"Bearer secret"},
+			wire.VersionHeader:      {"1"},
+			wire.OfflineQueueHeader: {"202"},
+		},
+	})
+	require.NoError(t, err)
+	socket.NetConn().Close()
 	time.Sleep(100 * time.Millisecond)
 
-	client, err := client.NewClient(client.Config{
-		Target:      "localhost:" + targetPort,
-		Server:      "localhost:" + serverPort,
-		Path:        "/_websocket",
-		AccessToken: "secret",
+	t.Run("Requests are accepted while offline", func(t *testing.T) {
+		for _, body := range []string{"first", "second", "third"} {
+			resp, err := http.Post("http://localhost:"+serverPort+"/hook", "text/plain", strings.NewReader(body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		}
 	})
-	if err != nil {
-		t.Fatalf("failed to start client: %v", err)
-	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	doneCh := make(chan struct{})
-	var gotErr error
-	defer cancel()
-	go func() {
-		defer close(doneCh)
-		err := client.Listen(context.Background())
-		if err != nil {
-			gotErr = err
+	t.Run("Queued requests are delivered in order on reconnect", func(t *testing.T) {
+		startClient(t, serverPort, client.Config{Target: target, OfflineQueue: http.StatusAccepted})
+
+		for _, want := range []string{"first", "second", "third"} {
+			select {
+			case got := <-received:
+				require.Equal(t, want, got)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %s", want)
+			}
 		}
+	})
+}
 
-		doneCh <- struct{}{}
-	}()
+func TestE2EOfflineQueueLiveTraffic(t *testing.T) {
+	release := make(chan struct{})
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("ok " + r.URL.Path))
+	}))
+	defer close(release)
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+
+	socket, _, err := gws.NewClient(&gws.BuiltinEventHandler{}, &gws.ClientOption{
+		Addr: "ws://localhost:" + serverPort + "/_websocket",
+		RequestHeader: http.Header{
+			"Authorization":         {"Bearer secret"},
+			wire.VersionHeader:      {"1"},
+			wire.OfflineQueueHeader: {"202"},
+		},
+	})
+	require.NoError(t, err)
+	socket.NetConn().Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Post("http://localhost:"+serverPort+"/slow", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// The queued request hangs at the target, live requests still go through.
+	startClient(t, serverPort, client.Config{Target: target, OfflineQueue: http.StatusAccepted})
+	live := &http.Client{Timeout: 5 * time.Second}
+	resp, err = live.Get("http://localhost:" + serverPort + "/live")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok /live", string(body))
+}
+
+func TestE2ECluster(t *testing.T) {
+	backends := []struct {
+		name    string
+		backend string
+		url     func(t *testing.T) string
+	}{
+		{"redis", pubsub.BackendRedis, func(t *testing.T) string {
+			return "redis://" + miniredis.RunT(t).Addr()
+		}},
+		{"nats", pubsub.BackendNATS, func(t *testing.T) string {
+			s, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1})
+			require.NoError(t, err)
+			go s.Start()
+			require.True(t, s.ReadyForConnections(5*time.Second))
+			t.Cleanup(s.Shutdown)
+			return s.ClientURL()
+		}},
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Hello, " + r.URL.Path))
+			}))
+
+			// Start two instances of the server on the shared bus
+			cfg := server.Config{
+				GithubUserProvider: githubLogin("client1"),
+				PubSub:             b.backend,
+				PubSubURL:          b.url(t),
+			}
+			serverA := startServer(t, cfg)
+			serverB := startServer(t, cfg)
+
+			// The client connects to the first instance only.
+			startClient(t, serverA, client.Config{Target: target})
+
+			// Requests reach the second instance with the host of the first,
+			// as they would through a load balancer in front of both.
+			host := "localhost:" + serverA
+
+			t.Run("Request landing on another instance reaches the client", func(t *testing.T) {
+				require.Eventually(t, func() bool {
+					req, err := http.NewRequest(http.MethodGet, "http://localhost:"+serverB+"/cluster", nil)
+					require.NoError(t, err)
+					req.Host = host
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						return false
+					}
+					defer resp.Body.Close()
+					body, err := io.ReadAll(resp.Body)
+					return err == nil && resp.StatusCode == http.StatusOK && string(body) == "Hello, /cluster"
+				}, 5*time.Second, 100*time.Millisecond)
+			})
 
-	select {
-	case <-ctx.Done():
-		break
-	case <-doneCh:
-		break
+			t.Run("Client connected to another instance is rejected", func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, "http://localhost:"+serverB+"/_websocket", nil)
+				require.NoError(t, err)
+				req.Host = host
+				req.Header.Set("Authorization", "Bearer secret")
+				req.Header.Set(wire.VersionHeader, strconv.Itoa(wire.ProtocolVersion))
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+				// The conflict names the connection holding the subdomain,
+				// as registered by the instance it is connected to.
+				var body struct{ Error string }
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+				require.Contains(t, body.Error, "client already connected from 127.0.0.1 since")
+			})
+		})
 	}
-	if gotErr == nil {
-		t.Fatalf("expected error, got nil")
+}
+
+func TestE2EAdmin(t *testing.T) {
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, world!"))
+	}))
+	serverPort := startServer(t, server.Config{
+		GithubUserProvider: func(token string) (auth.GitHubUser, error) {
+			return auth.GitHubUser{
+				Login: token,
+			}, nil
+		},
+		AdminLogins: []string{"ops", "ops2"},
+	})
+	startClient(t, serverPort, client.Config{Target: target, AccessToken: "client1", Version: "v1.2.3"})
+	subdomain := "localhost:" + serverPort
+
+	adminRequest := func(t *testing.T, method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, "http://localhost:"+serverPort+"/_admin"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
 	}
+
+	type tunnel struct {
+		Subdomain   string
+		Connections []struct {
+			Version     string
+			RemoteAddr  string    `json:"remote_addr"`
+			ConnectedAt time.Time `json:"connected_at"`
+		}
+		Stats inspect.Stats
+	}
+	listTunnels := func(t *testing.T) []tunnel {
+		resp := adminRequest(t, http.MethodGet, "/tunnels", "ops")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var list struct{ Tunnels []tunnel }
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		return list.Tunnels
+	}
+
+	t.Run("Non-admins are forbidden", func(t *testing.T) {
+		resp := adminRequest(t, http.MethodGet, "/tunnels", "client1")
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	var connectedAt time.Time
+	t.Run("Connected tunnels are listed with their stats", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:" + serverPort + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		tunnels := listTunnels(t)
+		require.Len(t, tunnels, 1)
+		require.Equal(t, subdomain, tunnels[0].Subdomain)
+		require.Len(t, tunnels[0].Connections, 1)
+		require.Equal(t, "v1.2.3", tunnels[0].Connections[0].Version)
+		require.Equal(t, "127.0.0.1", tunnels[0].Connections[0].RemoteAddr)
+		require.Equal(t, 1, tunnels[0].Stats.Requests)
+		connectedAt = tunnels[0].Connections[0].ConnectedAt
+	})
+
+	t.Run("Disconnected client reconnects", func(t *testing.T) {
+		resp := adminRequest(t, http.MethodDelete, "/tunnels/"+subdomain, "ops")
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		require.Eventually(t, func() bool {
+			tunnels := listTunnels(t)
+			return len(tunnels) == 1 && tunnels[0].Connections[0].ConnectedAt.After(connectedAt)
+		}, 10*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("Unknown tunnel", func(t *testing.T) {
+		resp := adminRequest(t, http.MethodDelete, "/tunnels/nobody", "ops")
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Blocked login cannot connect", func(t *testing.T) {
+		resp := adminRequest(t, http.MethodPut, "/blocked/client2", "ops")
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		c := newClient(t, serverPort, client.Config{Target: target, AccessToken: "client2", Name: "blocked"})
+		err := c.Listen(context.Background())
+		require.ErrorContains(t, err, "login blocked by an administrator")
+
+		resp = adminRequest(t, http.MethodGet, "/blocked", "ops")
+		defer resp.Body.Close()
+		var blocked struct{ Logins []string }
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&blocked))
+		require.Equal(t, []string{"client2"}, blocked.Logins)
+	})
+
+	t.Run("Blocked administrator loses access", func(t *testing.T) {
+		resp := adminRequest(t, http.MethodPut, "/blocked/ops2", "ops")
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = adminRequest(t, http.MethodDelete, "/blocked/ops2", "ops2")
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp = adminRequest(t, http.MethodGet, "/tunnels", "ops2")
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
 }
 
-func TestE2EServerUtilEndpoints(t *testing.T) {
+func TestE2EMetrics(t *testing.T) {
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.Copy(w, r.Body)
+	}))
+	serverMetricsPort := freePort(t)
+	serverPort := startServer(t, server.Config{
+		GithubUserProvider: func(token string) (auth.GitHubUser, error) {
+			if token != "secret" {
+				return auth.GitHubUser{}, fmt.Errorf("bad credentials")
+			}
+			return auth.GitHubUser{
+				Login: "client1",
+			}, nil
+		},
+		AdminLogins: []string{"client1"},
+		MetricsAddr: ":" + serverMetricsPort,
+	})
+	clientMetricsPort := freePort(t)
+	startClient(t, serverPort, client.Config{Target: target, Metrics: ":" + clientMetricsPort})
+	subdomain := "localhost:" + serverPort
+
+	scrape := func(t *testing.T, port string) string {
+		resp, err := http.Get("http://localhost:" + port + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	resp, err := http.Post("http://localhost:"+serverPort+"/echo", "text/plain", strings.NewReader("Hello, world!"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+serverPort+"/_api/tunnels/"+subdomain+"/requests", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	t.Run("Server metrics", func(t *testing.T) {
+		metrics := scrape(t, serverMetricsPort)
+		require.Contains(t, metrics, "reqbouncer_connected_clients 1\n")
+		require.Contains(t, metrics, `reqbouncer_forwarded_requests_total{code="201",subdomain="`+subdomain+`"} 1`)
+		require.Contains(t, metrics, `reqbouncer_tunnel_bytes_total{direction="in",subdomain="`+subdomain+`"} 13`)
+		require.Contains(t, metrics, `reqbouncer_tunnel_bytes_total{direction="out",subdomain="`+subdomain+`"} 13`)
+		require.Contains(t, metrics, "reqbouncer_tunnel_latency_seconds_count 1\n")
+		require.Contains(t, metrics, `reqbouncer_auth_failures_total{code="401"} 1`)
+	})
+
+	t.Run("Server metrics for administrators", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:"+serverPort+"/_admin/metrics", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "reqbouncer_connected_clients 1\n")
+
+		resp, err = http.Get("http://localhost:" + serverPort + "/_admin/metrics")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Client metrics", func(t *testing.T) {
+		metrics := scrape(t, clientMetricsPort)
+		require.Contains(t, metrics, "reqbouncer_client_connected 1\n")
+		require.Contains(t, metrics, `reqbouncer_client_requests_total{code="201"} 1`)
+		require.Contains(t, metrics, `reqbouncer_client_bytes_total{direction="out"} 13`)
+		require.Contains(t, metrics, "reqbouncer_client_target_latency_seconds_count 1\n")
+	})
+}
+
+// spanRecorder installs the tracer provider once, as tracers obtained from the
+// global provider stick to the first one set.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder
+})
+
+func TestE2ETracing(t *testing.T) {
+	// Server and client share the process, so both export to the recorder.
+	recorder := spanRecorder()
+
+	traceparents := make(chan string, 1)
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Write([]byte("Hello, world!"))
+	}))
+	serverPort := startServer(t, server.Config{GithubUserProvider: githubLogin("client1")})
+	startClient(t, serverPort, client.Config{Target: target})
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:"+serverPort+"/traced", nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var spans map[string]sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		spans = make(map[string]sdktrace.ReadOnlySpan)
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().TraceID().String() == traceId {
+				spans[span.Name()] = span
+			}
+		}
+		return len(spans) == 6
+	}, 5*time.Second, 50*time.Millisecond)
+
+	t.Run("Spans join the caller's trace", func(t *testing.T) {
+		for name, span := range spans {
+			require.Equal(t, traceId, span.SpanContext().TraceID().String(), name)
+		}
+		parent := func(child, parent string) {
+			require.Equal(t, spans[parent].SpanContext().SpanID(), spans[child].Parent().SpanID(), child)
+		}
+		require.Equal(t, "00f067aa0ba902b7", spans["reqbouncer.request"].Parent().SpanID().String())
+		parent("reqbouncer.tunnel", "reqbouncer.request")
+		parent("reqbouncer.publish", "reqbouncer.tunnel")
+		parent("reqbouncer.target", "reqbouncer.tunnel")
+		parent("reqbouncer.respond", "reqbouncer.tunnel")
+		parent("reqbouncer.response", "reqbouncer.request")
+	})
+
+	t.Run("Target receives the traceparent of the client span", func(t *testing.T) {
+		target := spans["reqbouncer.target"].SpanContext()
+		require.Equal(t, "00-"+traceId+"-"+target.SpanID().String()+"-01", <-traceparents)
+	})
+}
+
+func TestE2EGracefulShutdown(t *testing.T) {
 	logger, _ := slogger.NewSlogger(true)
-	serverPort := "50005"
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("finally"))
+	}))
 
+	// The server is run by hand, as the test shuts it down halfway.
+	serverPort := freePort(t)
+	ctx, shutdown := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
 	go func() {
-		// Start server
-		err := server.Start(logger, server.Config{
-			GithubClientid: "client1",
-			GithubUserProvider: func(token string) (auth.GitHubUser, error) {
-				return auth.GitHubUser{
-					Login: "client1",
-				}, nil
-			},
-			Port: serverPort,
+		stopped <- server.Run(ctx, logger, server.Config{
+			// The raw client below connects through 127.0.0.1, so its
+			// subdomain is 127.
+			GithubUserProvider: githubLogin("127"),
+			Port:               serverPort,
+			ShutdownTimeout:    5 * time.Second,
 		})
+	}()
+	t.Cleanup(shutdown)
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://localhost:" + serverPort + "/_health")
 		if err != nil {
-			t.Fatalf("failed to start server: %v", err)
+			return false
 		}
-	}()
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// The client keeps trying to reconnect once the server is gone, until
+	// the test ends.
+	startClient(t, serverPort, client.Config{Target: target})
+
+	received := make(chan string, 1)
+	socket, resp, err := gws.NewClient(&wsRecorder{received: received}, &gws.ClientOption{
+		Addr: "ws://127.0.0.1:" + serverPort + "/_websocket",
+		RequestHeader: http.Header{
+			"Authorization":         {"Bearer secret"},
+			wire.VersionHeader:      {strconv.Itoa(wire.ProtocolVersion)},
+			wire.CapabilitiesHeader: {string(wire.CapGoAway)},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	defer socket.NetConn().Close()
+	go socket.ReadLoop()
 
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://localhost:" + serverPort + "/slow")
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inflight <- result{status: resp.StatusCode, body: string(body), err: err}
+	}()
 	time.Sleep(100 * time.Millisecond)
-	// Start client
+	shutdown()
+
+	t.Run("In-flight request completes", func(t *testing.T) {
+		res := <-inflight
+		require.NoError(t, res.err)
+		require.Equal(t, http.StatusOK, res.status)
+		require.Equal(t, "finally", res.body)
+	})
+
+	t.Run("New requests are refused", func(t *testing.T) {
+		_, err := http.Get("http://localhost:" + serverPort + "/slow")
+		require.Error(t, err)
+	})
+
+	t.Run("Clients are told to reconnect elsewhere", func(t *testing.T) {
+		select {
+		case got := <-received:
+			var frame wire.WireMessage
+			require.NoError(t, wire.JSON.Decode([]byte(got), &frame))
+			require.Equal(t, wire.FrameControl, frame.Type)
+			ctrl, err := wire.ParseControl(frame.Payload)
+			require.NoError(t, err)
+			require.Equal(t, wire.ControlGoingAway, ctrl.Kind)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the going away control frame")
+		}
+	})
+
+	t.Run("Server stops", func(t *testing.T) {
+		select {
+		case err := <-stopped:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the server to stop")
+		}
+	})
+}
+
+func TestE2EGitHubOrgAccess(t *testing.T) {
+	// Stand-in for api.github.com where alice belongs to the acme
+	// organization and bob does not.
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer gho_")
+		switch r.URL.Path {
+		case "/user":
+			json.NewEncoder(w).Encode(auth.GitHubUser{Login: login})
+		case "/user/memberships/orgs/acme":
+			if login != "alice" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"state": "active"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer github.Close()
+
+	target := startTarget(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, acme!"))
+	}))
+	serverPort := startServer(t, server.Config{
+		GithubUserProvider: auth.NewGitHubUserProvider(github.URL),
+		Auth: authn.Config{
+			GitHub: authn.GitHubAccess{APIURL: github.URL, Orgs: []string{"acme"}},
+		},
+	})
+
+	t.Run("Non-members are told why they are denied", func(t *testing.T) {
+		err := newClient(t, serverPort, client.Config{Target: target, AccessToken: "gho_bob"}).Listen(context.Background())
+		require.ErrorContains(t, err, "permission denied: access denied: bob is not a member of the GitHub organization acme")
+	})
+
+	t.Run("Members open tunnels", func(t *testing.T) {
+		startClient(t, serverPort, client.Config{Target: target, AccessToken: "gho_alice"})
+		require.Eventually(t, func() bool {
+			resp, err := http.Get("http://localhost:" + serverPort + "/")
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			return err == nil && string(body) == "Hello, acme!"
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
+
+func TestE2EServerUtilEndpoints(t *testing.T) {
+	serverPort := startServer(t, server.Config{
+		GithubClientid:     "client1",
+		GithubUserProvider: githubLogin("client1"),
+	})
 
 	t.Run("health", func(t *testing.T) {
 		resp, err := http.Get("http://localhost:" + serverPort + "/_health")
@@ -280,3 +1214,24 @@ func TestE2EServerUtilEndpoints(t *testing.T) {
 		require.Equal(t, "client1", githubClientId)
 	})
 }
+
+// wsEchoHandler is a target websocket endpoint echoing every message.
+type wsEchoHandler struct {
+	gws.BuiltinEventHandler
+}
+
+func (h *wsEchoHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+}
+
+// wsRecorder is a public websocket caller collecting the messages it receives.
+type wsRecorder struct {
+	gws.BuiltinEventHandler
+	received chan string
+}
+
+func (h *wsRecorder) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	h.received <- message.Data.String()
+}
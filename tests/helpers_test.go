@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/znowdev/reqbouncer/internal/client"
+	"github.com/znowdev/reqbouncer/internal/client/auth"
+	"github.com/znowdev/reqbouncer/internal/server"
+	"github.com/znowdev/reqbouncer/internal/slogger"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// githubLogin stands in for GitHub, authenticating every token as login.
+func githubLogin(login string) auth.GithubUserProvider {
+	return func(token string) (auth.GitHubUser, error) {
+		return auth.GitHubUser{Login: login}, nil
+	}
+}
+
+// freePort returns a port nothing listens on right now.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// startServer runs a server with cfg on a free port until the test ends and
+// returns the port once it is healthy.
+func startServer(t *testing.T, cfg server.Config) string {
+	t.Helper()
+	logger, _ := slogger.NewSlogger(true)
+	cfg.Port = freePort(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		defer close(done)
+		runErr = server.Run(ctx, logger, cfg)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		if runErr != nil {
+			t.Errorf("server stopped: %v", runErr)
+		}
+	})
+
+	require.Eventually(t, func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+		}
+		resp, err := http.Get("http://localhost:" + cfg.Port + "/_health")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("server stopped while starting")
+	default:
+	}
+	return cfg.Port
+}
+
+// startTarget serves handler until the test ends and returns its address.
+func startTarget(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	target := httptest.NewServer(handler)
+	t.Cleanup(target.Close)
+	return target.Listener.Addr().String()
+}
+
+// newClient returns a client with cfg for the server on serverPort. The
+// access token is "secret" unless cfg sets one.
+func newClient(t *testing.T, serverPort string, cfg client.Config) *client.Client {
+	t.Helper()
+	cfg.Server = "localhost:" + serverPort
+	cfg.Path = "/_websocket"
+	if cfg.AccessToken == "" {
+		cfg.AccessToken = "secret"
+	}
+	c, err := client.NewClient(cfg)
+	require.NoError(t, err)
+	return c
+}
+
+// startClient connects a client with cfg to the server on serverPort until
+// the test ends, see newClient.
+func startClient(t *testing.T, serverPort string, cfg client.Config) {
+	t.Helper()
+	c := newClient(t, serverPort, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := c.Listen(ctx); err != nil && ctx.Err() == nil {
+			t.Errorf("client stopped: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// Give the client time to connect.
+	time.Sleep(200 * time.Millisecond)
+}